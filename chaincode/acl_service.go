@@ -0,0 +1,358 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"sort"
+)
+
+// Access to every invoke and query function is granted to roles in the
+// Permissions table. A permission may also require the caller to hold a
+// capability, such as issuer approval, granted to the member in the
+// Capabilities table. The system role edits both without redeploying.
+// ANY_ROLE grants a function to every caller, e.g. payment callbacks that are
+// verified by the rail's signature instead.
+
+const ANY_ROLE = "*"
+
+type functionPolicy struct {
+	Roles      []string
+	Capability string
+}
+
+// defaultPolicies are seeded into the Permissions table at deploy time.
+var defaultPolicies = map[string]functionPolicy{
+	// invoke
+	"createBond":           {Roles: []string{"issuer"}},
+	"approveBond":          {Roles: []string{"issuer", "bank"}},
+	"rejectBond":           {Roles: []string{"issuer", "bank"}},
+	"restrictBond":         {Roles: []string{"issuer"}},
+	"buy":                  {Roles: []string{"investor"}},
+	"sell":                 {Roles: []string{"investor"}},
+	"confirm":              {Roles: []string{ANY_ROLE}},
+	"payContractCoupon":    {Roles: []string{ANY_ROLE}},
+	"payNettedCoupons":     {Roles: []string{ANY_ROLE}},
+	"payFee":               {Roles: []string{ANY_ROLE}},
+	"payWithholding":       {Roles: []string{ANY_ROLE}},
+	"payRefund":            {Roles: []string{ANY_ROLE}},
+	"paymentFailed":        {Roles: []string{ANY_ROLE}},
+	"paymentReversed":      {Roles: []string{ANY_ROLE}},
+	"payCoupons":           {Roles: []string{"system"}},
+	"checkCouponDefaults":  {Roles: []string{"system"}},
+	"releaseExpiredTrades": {Roles: []string{"system"}},
+	"setCouponNetting":     {Roles: []string{"system"}},
+	"setGracePeriod":       {Roles: []string{"system"}},
+	"setSettlementPeriod":  {Roles: []string{"system"}},
+	"setPositionLimit":     {Roles: []string{"system"}},
+	"setConcentrationLimit": {Roles: []string{"system"}},
+	"setExposureLimit":     {Roles: []string{"system"}},
+	"setFeeSchedule":       {Roles: []string{"system"}},
+	"setWithholdingRate":   {Roles: []string{"system"}},
+	"setChainCodeId":       {Roles: []string{"system"}},
+	"setPaymentChaincode":  {Roles: []string{"system"}},
+	"setTokenChaincode":    {Roles: []string{"system"}},
+	"setPaymentRail":       {Roles: []string{"system"}},
+	"setRailKey":           {Roles: []string{"system"}},
+	"openBidding":          {Roles: []string{"issuer"}},
+	"closeBidding":         {Roles: []string{"issuer"}},
+	"commitBid":            {Roles: []string{"investor"}},
+	"revealBid":            {Roles: []string{"investor"}},
+	"hitBid":               {Roles: []string{"issuer", "investor"}},
+	"deposit":              {Roles: []string{"custodian"}},
+	"withdraw":             {Roles: []string{"custodian"}},
+	"transfer":             {Roles: []string{"investor", "issuer"}},
+	"grantPermission":      {Roles: []string{"system"}},
+	"revokePermission":     {Roles: []string{"system"}},
+	"grantCapability":      {Roles: []string{"system"}},
+	"revokeCapability":     {Roles: []string{"system"}},
+	"whitelistInvestor":    {Roles: []string{"compliance"}},
+	"delistInvestor":       {Roles: []string{"compliance"}},
+	"publishSanctions":     {Roles: []string{"compliance"}},
+	"releaseHeldTrade":     {Roles: []string{"compliance"}},
+	"rejectHeldTrade":      {Roles: []string{"compliance"}},
+	"releaseHeldPayment":   {Roles: []string{"compliance"}},
+	"rejectHeldPayment":    {Roles: []string{"compliance"}},
+	// query
+	"getBonds":             {Roles: []string{"issuer"}},
+	"getContracts":         {Roles: []string{"issuer", "investor", "auditor"}},
+	"getTrades":            {Roles: []string{"investor", "auditor", "compliance"}},
+	"getContractHistory":   {Roles: []string{"issuer", "investor", "auditor"}},
+	"getDefaults":          {Roles: []string{"auditor"}},
+	"getPayments":          {Roles: []string{"investor", "issuer", "auditor", "system", "bank", "compliance"}},
+	"getBalances":          {Roles: []string{"investor", "issuer", "custodian", "auditor"}},
+	"getPaymentChaincode":  {Roles: []string{ANY_ROLE}},
+	"getBids":              {Roles: []string{"issuer", "investor", "auditor"}},
+	"getFeeSchedule":       {Roles: []string{ANY_ROLE}},
+	"getFees":              {Roles: []string{"auditor"}},
+	"getWithholdings":      {Roles: []string{"investor", "auditor"}},
+	"getWithholdingRates":  {Roles: []string{ANY_ROLE}},
+	"getProposals":         {Roles: []string{"issuer", "bank", "auditor"}},
+	"getPermissions":       {Roles: []string{"system", "auditor"}},
+	"getCapabilities":      {Roles: []string{ANY_ROLE}},
+	"getLimitUtilization":  {Roles: []string{"investor", "auditor", "compliance"}},
+	"getWhitelist":         {Roles: []string{"compliance", "auditor"}},
+	"getIneligibleHoldings": {Roles: []string{"compliance", "auditor"}},
+}
+
+// functions the system role keeps so that it cannot lock itself out
+var aclFunctions = []string{"grantPermission", "revokePermission", "grantCapability", "revokeCapability"}
+
+type permission struct {
+	Function   string `json:"function"`
+	Role       string `json:"role"`
+	Capability string `json:"capability"`
+}
+
+type capability struct {
+	MemberId   string `json:"memberId"`
+	Capability string `json:"capability"`
+}
+
+func (permission_ *permission) readFromRow(row shim.Row) {
+	permission_.Function 	= row.Columns[0].GetString_()
+	permission_.Role 	= row.Columns[1].GetString_()
+	permission_.Capability 	= row.Columns[2].GetString_()
+}
+
+func (permission_ *permission) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: permission_.Function}},
+			&shim.Column{Value: &shim.Column_String_{String_: permission_.Role}},
+			&shim.Column{Value: &shim.Column_String_{String_: permission_.Capability}}},
+	}
+}
+
+func (capability_ *capability) readFromRow(row shim.Row) {
+	capability_.MemberId 	= row.Columns[0].GetString_()
+	capability_.Capability 	= row.Columns[1].GetString_()
+}
+
+func (capability_ *capability) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: capability_.MemberId}},
+			&shim.Column{Value: &shim.Column_String_{String_: capability_.Capability}}},
+	}
+}
+
+func (t *BondChaincode) initPermissions(stub shim.ChaincodeStubInterface) (error) {
+	// Create permissions table
+	err := stub.CreateTable("Permissions", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Function", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Capability", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Permissions")
+		return errors.New("Failed creating Permissions table.")
+	}
+
+	// Create capabilities table
+	err = stub.CreateTable("Capabilities", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "MemberId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Capability", Type: shim.ColumnDefinition_STRING, Key: true},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Capabilities")
+		return errors.New("Failed creating Capabilities table.")
+	}
+
+	// seed in a stable order, map iteration order is random
+	var functions []string
+	for function := range defaultPolicies {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+
+	for _, function := range functions {
+		policy := defaultPolicies[function]
+		for _, role := range policy.Roles {
+			if err := t.grantPermission(stub, permission{Function: function, Role: role, Capability: policy.Capability}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) grantPermission(stub shim.ChaincodeStubInterface, permission_ permission) (error) {
+	if permission_.Function == "" || permission_.Role == "" {
+		return errors.New("Incorrect permission. Expecting function and role.")
+	}
+	log.Debugf("grantPermission: %+v", permission_)
+
+	ok, err := stub.InsertRow("Permissions", permission_.toRow())
+	if err != nil {
+		log.Error("Failed inserting permission: " + err.Error())
+		return err
+	}
+	if !ok {
+		if _, err := stub.ReplaceRow("Permissions", permission_.toRow()); err != nil {
+			log.Error("Failed replacing permission: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *BondChaincode) revokePermission(stub shim.ChaincodeStubInterface, function string, role string) (error) {
+	if role == "system" {
+		for _, aclFunction := range aclFunctions {
+			if function == aclFunction {
+				return errors.New("Permission of system role to " + function + " cannot be revoked")
+			}
+		}
+	}
+	log.Debugf("revokePermission: %s from %s", function, role)
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: function}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: role}}
+	columns = append(columns, col2)
+
+	return stub.DeleteRow("Permissions", columns)
+}
+
+func (t *BondChaincode) getPermission(stub shim.ChaincodeStubInterface, function string, role string) (permission, bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: function}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: role}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("Permissions", columns)
+	if err != nil {
+		message := "Failed retrieving permission. Error: " + err.Error()
+		log.Error(message)
+		return permission{}, false, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return permission{}, false, nil
+	}
+
+	var result permission
+	result.readFromRow(row)
+	return result, true, nil
+}
+
+func (t *BondChaincode) getPermissions(stub shim.ChaincodeStubInterface, function string) (permissions []permission, err error) {
+	var columns []shim.Column
+	if function != "" {
+		columnFunction := shim.Column{Value: &shim.Column_String_{String_: function}}
+		columns = append(columns, columnFunction)
+	}
+
+	rows, err := stub.GetRows("Permissions", columns)
+	if err != nil {
+		message := "Failed retrieving permissions. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result permission
+		result.readFromRow(row)
+		permissions = append(permissions, result)
+	}
+
+	return permissions, nil
+}
+
+// checkPermission lets the caller call the function if its role, or any role,
+// is permitted to and the caller holds the capability the permission requires.
+func (t *BondChaincode) checkPermission(stub shim.ChaincodeStubInterface, function string, callerName string, callerRole string) (error) {
+	permission_, ok, err := t.getPermission(stub, function, callerRole)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		permission_, ok, err = t.getPermission(stub, function, ANY_ROLE)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		log.Errorf("checkPermission denied %s to %s of role %s", function, callerName, callerRole)
+		return errors.New("Incorrect caller role. Role " + callerRole + " is not permitted to call " + function + ".")
+	}
+
+	if permission_.Capability != "" {
+		held, err := t.hasCapability(stub, callerName, permission_.Capability)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return errors.New("Caller " + callerName + " lacks capability " + permission_.Capability + " to call " + function + ".")
+		}
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) grantCapability(stub shim.ChaincodeStubInterface, memberId string, capability_ string) (error) {
+	if memberId == "" || capability_ == "" {
+		return errors.New("Incorrect capability. Expecting memberId and capability.")
+	}
+	log.Debugf("grantCapability: %s to %s", capability_, memberId)
+
+	row := capability{MemberId: memberId, Capability: capability_}
+	if _, err := stub.InsertRow("Capabilities", row.toRow()); err != nil {
+		log.Error("Failed inserting capability: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+func (t *BondChaincode) revokeCapability(stub shim.ChaincodeStubInterface, memberId string, capability_ string) (error) {
+	log.Debugf("revokeCapability: %s from %s", capability_, memberId)
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: memberId}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: capability_}}
+	columns = append(columns, col2)
+
+	return stub.DeleteRow("Capabilities", columns)
+}
+
+func (t *BondChaincode) hasCapability(stub shim.ChaincodeStubInterface, memberId string, capability_ string) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: memberId}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: capability_}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("Capabilities", columns)
+	if err != nil {
+		message := "Failed retrieving capability. Error: " + err.Error()
+		log.Error(message)
+		return false, errors.New(message)
+	}
+	return len(row.Columns) != 0, nil
+}
+
+func (t *BondChaincode) getCapabilities(stub shim.ChaincodeStubInterface, memberId string) (capabilities []capability, err error) {
+	var columns []shim.Column
+	if memberId != "" {
+		columnMemberId := shim.Column{Value: &shim.Column_String_{String_: memberId}}
+		columns = append(columns, columnMemberId)
+	}
+
+	rows, err := stub.GetRows("Capabilities", columns)
+	if err != nil {
+		message := "Failed retrieving capabilities. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result capability
+		result.readFromRow(row)
+		capabilities = append(capabilities, result)
+	}
+
+	return capabilities, nil
+}
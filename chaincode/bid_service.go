@@ -0,0 +1,359 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Sealed bids follow a commit-reveal protocol: while the commit window is open
+// investors submit only sha256("price:quantity:salt") in hex, after it closes
+// they reveal price, quantity and salt which are checked against the hash.
+// Bids never revealed are discarded when bidding is closed. A revealed bid may
+// be filled over several hits, it stays partial until its quantity is filled.
+
+type bid struct {
+	BondId   string `json:"bondId"`
+	BidderId string `json:"bidderId"`
+	Company  string `json:"company"`
+	Hash     string `json:"hash"`
+	Price    uint64 `json:"price"`
+	Quantity uint64 `json:"quantity"`
+	Filled   uint64 `json:"filled"`
+	State    string `json:"state"`
+}
+
+type bidWindow struct {
+	CommitEnd uint64 `json:"commitEnd"`
+	RevealEnd uint64 `json:"revealEnd"`
+}
+
+func (bid_ *bid) readFromRow(row shim.Row) {
+	bid_.BondId 	= row.Columns[0].GetString_()
+	bid_.BidderId 	= row.Columns[1].GetString_()
+	bid_.Hash 	= row.Columns[2].GetString_()
+	bid_.Price 	= row.Columns[3].GetUint64()
+	bid_.Quantity 	= row.Columns[4].GetUint64()
+	bid_.State 	= row.Columns[5].GetString_()
+	bid_.Company 	= row.Columns[6].GetString_()
+	bid_.Filled 	= row.Columns[7].GetUint64()
+}
+
+func (bid_ *bid) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: bid_.BondId}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid_.BidderId}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid_.Hash}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid_.Price}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid_.Quantity}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid_.State}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid_.Company}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid_.Filled}}},
+	}
+}
+
+func (t *BondChaincode) initBids(stub shim.ChaincodeStubInterface) (error) {
+	// Create bids table
+	err := stub.CreateTable("Bids", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BondId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "BidderId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Hash", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Price", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Quantity", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Company", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Filled", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Bids")
+		return errors.New("Failed creating Bids table.")
+	}
+
+	return nil
+}
+
+func bidHash(price uint64, quantity uint64, salt string) string {
+	digest := sha256.Sum256([]byte(strconv.FormatUint(price, 10) + ":" + strconv.FormatUint(quantity, 10) + ":" + salt))
+	return hex.EncodeToString(digest[:])
+}
+
+func (t *BondChaincode) getBidWindow(stub shim.ChaincodeStubInterface, bondId string) (bidWindow, error) {
+	var window bidWindow
+
+	windowBytes, err := stub.GetState("bidwindow." + bondId)
+	if err != nil {
+		return window, err
+	}
+	if len(windowBytes) == 0 {
+		return window, errors.New("Bidding is not open for bond " + bondId)
+	}
+
+	err = json.Unmarshal(windowBytes, &window)
+	return window, err
+}
+
+func (t *BondChaincode) openBidding(stub shim.ChaincodeStubInterface, bondId string, commitEnd uint64, revealEnd uint64, callerName string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "openBidding", bondId)
+
+	if _, err := t.getBond(stub, callerName, bondId); err != nil {
+		return nil, errors.New("Only issuer can open bidding on a bond")
+	}
+	if commitEnd >= revealEnd {
+		return nil, errors.New("Commit window must end before reveal window.")
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if commitEnd <= now {
+		return nil, errors.New("Commit window must end in the future.")
+	}
+	// an open window cannot be moved and committed bids cannot be dropped
+	if window, err := t.getBidWindow(stub, bondId); err == nil && now < window.RevealEnd {
+		return nil, errors.New("Bidding is already open for bond " + bondId)
+	}
+	bids, err := t.getBids(stub, bondId, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(bids) > 0 {
+		return nil, errors.New("Bond " + bondId + " has bids already")
+	}
+
+	windowBytes, err := json.Marshal(bidWindow{CommitEnd: commitEnd, RevealEnd: revealEnd})
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState("bidwindow." + bondId, windowBytes)
+}
+
+func (t *BondChaincode) commitBid(stub shim.ChaincodeStubInterface, bondId string, hash string, callerName string, callerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "commitBid", bondId)
+
+	window, err := t.getBidWindow(stub, bondId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now >= window.CommitEnd {
+		return nil, errors.New("Commit window is closed for bond " + bondId)
+	}
+
+	// a bidder may replace the sealed bid while the commit window is open
+	bid_ := bid{BondId: bondId, BidderId: callerName, Company: callerCompany, Hash: strings.ToLower(hash), State: "committed"}
+	if ok, err := stub.InsertRow("Bids", bid_.toRow()); !ok {
+		if err != nil {
+			log.Error("Failed inserting new bid: " + err.Error())
+			return nil, err
+		}
+		if _, err := stub.ReplaceRow("Bids", bid_.toRow()); err != nil {
+			log.Error("Failed replacing bid: " + err.Error())
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *BondChaincode) revealBid(stub shim.ChaincodeStubInterface, bondId string, price uint64, quantity uint64, salt string, callerName string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "revealBid", bondId)
+
+	window, err := t.getBidWindow(stub, bondId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now < window.CommitEnd || now >= window.RevealEnd {
+		return nil, errors.New("Reveal window is closed for bond " + bondId)
+	}
+
+	bid_, err := t.getBid(stub, bondId, callerName)
+	if err != nil {
+		return nil, err
+	}
+	if bid_.State != "committed" {
+		return nil, errors.New("Bid is already " + bid_.State)
+	}
+	if bidHash(price, quantity, salt) != bid_.Hash {
+		return nil, errors.New("Revealed bid does not match committed hash")
+	}
+
+	bid_.Price = price
+	bid_.Quantity = quantity
+	bid_.State = "revealed"
+	if ok, err := stub.ReplaceRow("Bids", bid_.toRow()); !ok {
+		log.Error("Failed revealing bid: " + err.Error())
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (t *BondChaincode) closeBidding(stub shim.ChaincodeStubInterface, bondId string, callerName string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "closeBidding", bondId)
+
+	if _, err := t.getBond(stub, callerName, bondId); err != nil {
+		return nil, errors.New("Only issuer can close bidding on a bond")
+	}
+	window, err := t.getBidWindow(stub, bondId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now < window.RevealEnd {
+		return nil, errors.New("Reveal window is still open for bond " + bondId)
+	}
+
+	bids, err := t.getBids(stub, bondId, "")
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, bid_ := range bids {
+		if bid_.State != "committed" {
+			continue
+		}
+		bid_.State = "discarded"
+		if ok, err := stub.ReplaceRow("Bids", bid_.toRow()); !ok {
+			log.Error("Failed discarding bid: " + err.Error())
+			return nil, err
+		}
+		count++
+	}
+	log.Debugf("closeBidding discarded %d unrevealed bids out of %d", count, len(bids))
+
+	return nil, nil
+}
+
+// hitBid fills a revealed bid from the offers on the bond of the caller or its company at the bid price.
+func (t *BondChaincode) hitBid(stub shim.ChaincodeStubInterface, bondId string, bidderId string, callerName string, callerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s", "hitBid", bondId, bidderId)
+
+	window, err := t.getBidWindow(stub, bondId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now < window.RevealEnd {
+		return nil, errors.New("Reveal window is still open for bond " + bondId)
+	}
+	if err := t.checkEligibility(stub, bidderId, now); err != nil {
+		log.Error("hitBid rejected: " + err.Error())
+		return nil, err
+	}
+
+	bid_, err := t.getBid(stub, bondId, bidderId)
+	if err != nil {
+		return nil, err
+	}
+	if bid_.State != "revealed" && bid_.State != "partial" {
+		return nil, errors.New("Only revealed bids can be filled")
+	}
+
+	offers, err := t.getTradesByType(stub, "offer")
+	if err != nil {
+		return nil, err
+	}
+
+	var filled uint64
+	for _, trade_ := range offers {
+		if bid_.Filled + filled == bid_.Quantity {
+			break
+		}
+		ownOffer := trade_.SellerId == callerName || (callerCompany != "" && trade_.SellerCompany == callerCompany)
+		if !ownOffer || trade_.ContractId[:strings.LastIndex(trade_.ContractId, ".")] != bondId {
+			continue
+		}
+
+		trade_.Price = bid_.Price
+		if err := t.updateTrade(stub, trade_); err != nil {
+			return nil, err
+		}
+		if _, err := t.buy(stub, trade_.Id, bidderId, bid_.Company, ""); err != nil {
+			return nil, err
+		}
+		filled++
+	}
+	if filled == 0 {
+		return nil, errors.New("No offers to fill bid for bond " + bondId)
+	}
+	bid_.Filled += filled
+	log.Debugf("hitBid filled %d, %d out of %d contracts in total", filled, bid_.Filled, bid_.Quantity)
+
+	bid_.State = "partial"
+	if bid_.Filled == bid_.Quantity {
+		bid_.State = "filled"
+	}
+	if ok, err := stub.ReplaceRow("Bids", bid_.toRow()); !ok {
+		log.Error("Failed filling bid: " + err.Error())
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (t *BondChaincode) getBid(stub shim.ChaincodeStubInterface, bondId string, bidderId string) (bid, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: bondId}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: bidderId}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("Bids", columns)
+	if err != nil {
+		message := "Failed retrieving bid. Error: " + err.Error()
+		log.Error(message)
+		return bid{}, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return bid{}, errors.New("No bid found for " + bidderId + " on bond " + bondId)
+	}
+
+	var result bid
+	result.readFromRow(row)
+	return result, nil
+}
+
+func (t *BondChaincode) getBids(stub shim.ChaincodeStubInterface, bondId string, bidderId string) (bids []bid, err error) {
+	var columns []shim.Column
+	if bondId != "" {
+		columnBondId := shim.Column{Value: &shim.Column_String_{String_: bondId}}
+		columns = append(columns, columnBondId)
+	}
+
+	rows, err := stub.GetRows("Bids", columns)
+	if err != nil {
+		message := "Failed retrieving bids. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result bid
+		result.readFromRow(row)
+		if bidderId != "" && result.BidderId != bidderId {
+			continue
+		}
+		log.Debugf("getBids result includes: %+v", result)
+		bids = append(bids, result)
+	}
+
+	return bids, nil
+}
@@ -8,10 +8,14 @@ import (
 
 	"encoding/json"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var log = logging.MustGetLogger("bond-traiding")
 const PRICE_PER_CONTRACT uint64 = 100000
+// seconds a reserved trade waits for payment before it is released
+const SETTLEMENT_PERIOD uint64 = 86400
 
 // SimpleChaincode example simple Chaincode implementation
 type BondChaincode struct {
@@ -39,6 +43,80 @@ func (t *BondChaincode) Init(stub shim.ChaincodeStubInterface, function string,
 		log.Criticalf("function: %s, args: %s", function, args)
 		return nil, errors.New("Failed creating Trades table.")
 	}
+	// Create trade history table
+	err = t.initTradeHistory(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating TradeHistory table.")
+	}
+	// Create bids table
+	err = t.initBids(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Bids table.")
+	}
+	// Create balances table
+	err = t.initBalances(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Balances table.")
+	}
+	// Create payments table
+	err = t.initPayments(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Payments table.")
+	}
+	// Create members table
+	err = t.initMembers(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Members table.")
+	}
+	// Create withholding tables
+	err = t.initWithholdings(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Withholdings table.")
+	}
+	// Create proposals table
+	err = t.initProposals(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Proposals table.")
+	}
+	// Create whitelist table
+	err = t.initWhitelist(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Whitelist table.")
+	}
+	// Create transfer restrictions table
+	err = t.initRestrictions(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Restrictions table.")
+	}
+	// Create sanctions table
+	err = t.initSanctions(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Sanctions table.")
+	}
+	// Create permissions tables with the default policy
+	err = t.initPermissions(stub)
+	if err != nil {
+		log.Criticalf("function: %s, args: %s", function, args)
+		return nil, errors.New("Failed creating Permissions table.")
+	}
+	// Payment chaincode may be configured at deploy time or later via setPaymentChaincode
+	if len(args) > 0 {
+		err = t.setPaymentChaincode(stub, "paymentchaincode", args)
+		if err != nil {
+			log.Criticalf("function: %s, args: %s", function, args)
+			return nil, err
+		}
+	}
 
 	return nil, nil
 }
@@ -48,16 +126,19 @@ func (t *BondChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 
 	callerName := t.getCallerName(stub)
 	callerRole := t.getCallerRole(stub)
+	callerCompany := t.getCallerCompany(stub)
+	callerJurisdiction := t.getCallerJurisdiction(stub)
+
+	log.Debugf("role: %s, name: %s, company: %s, jurisdiction: %s", callerRole, callerName, callerCompany, callerJurisdiction)
 
-	log.Debugf("role: %s, name: %s", callerRole, callerName)
+	if err := t.checkPermission(stub, function, callerName, callerRole); err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "createBond" {
-		if len(args) != 4 {
-			return nil, errors.New("Incorrect arguments. Expecting maturityDate, principal, rate and term.")
-		}
-		if callerRole != "issuer" {
-			return nil, errors.New("Incorrect caller role. Expecting issuer.")
+		if len(args) < 4 || len(args) > 8 {
+			return nil, errors.New("Incorrect arguments. Expecting maturityDate, principal, rate, term and optional currency, arranger, peril, region.")
 		}
 
 		var newBond bond
@@ -82,55 +163,126 @@ func (t *BondChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 			return nil, errors.New("Incorrect term. Uint64 expected.")
 		}
 		newBond.Term = term
+
+		newBond.Currency = DEFAULT_CURRENCY
+		if len(args) > 4 {
+			if !isCurrencyCode(args[4]) {
+				return nil, errors.New("Incorrect currency. ISO 4217 code expected.")
+			}
+			newBond.Currency = args[4]
+		}
+		// peril and region the bond is exposed to count towards investors' exposure limits
+		if len(args) > 6 {
+			newBond.Trigger = args[6]
+		}
+		if len(args) > 7 {
+			newBond.Region = args[7]
+		}
 		newBond.State = "active"
 		newBond.Id = newBond.IssuerId + "." + newBond.MaturityDate + "." + strconv.FormatUint(newBond.Rate, 10)
 		newBond.CouponsPaid = 0
 
-		if msg, err := t.createBond(stub, newBond); err != nil {
-			return msg, err
+		// the issuer's jurisdiction is needed for withholding on coupons
+		if err := t.saveMember(stub, member{Id: callerName, Role: callerRole, Company: callerCompany, Jurisdiction: callerJurisdiction}); err != nil {
+			return nil, err
 		}
-		return t.createContractsForBond(stub, newBond, principal/PRICE_PER_CONTRACT)
 
-	} else if function == "buy" {
-		if callerRole != "investor" {
-			return nil, errors.New("Incorrect caller role. Expecting investor.")
+		// the bond is issued once the proposal is approved
+		var arranger string
+		if len(args) > 5 {
+			arranger = args[5]
 		}
+		return t.proposeBond(stub, newBond, callerCompany, arranger)
 
+	} else if function == "approveBond" {
 		if len(args) != 1 {
-			return nil, errors.New("Incorrect arguments. Expecting tradeId.")
+			return nil, errors.New("Incorrect arguments. Expecting proposalId.")
+		}
+
+		return t.approveBond(stub, args[0], callerName, callerRole, callerCompany)
+
+	} else if function == "rejectBond" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting proposalId, reason.")
+		}
+
+		return t.rejectBond(stub, args[0], args[1], callerName, callerRole, callerCompany)
+
+	} else if function == "restrictBond" {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect arguments. Expecting proposalId, lockupEnd, jurisdictions, maxHolders.")
+		}
+
+		lockupEnd, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect lockupEnd. Uint64 expected.")
+		}
+		maxHolders, err := strconv.ParseUint(args[3], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect maxHolders. Uint64 expected.")
+		}
+
+		// jurisdictions are comma separated, empty allows any
+		restriction := transferRestriction{LockupEnd: lockupEnd, Jurisdictions: splitJurisdictions(args[2]), MaxHolders: maxHolders}
+		return t.restrictBond(stub, args[0], restriction, callerName)
+
+	} else if function == "buy" {
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting tradeId and optional currency.")
 		}
 
 		tradeId, err := strconv.ParseUint(args[0], 10, 64)
 		if err != nil {
 			return nil, errors.New("Incorrect tradeId. Uint64 expected.")
 		}
-		
-		return t.buy(stub, tradeId, callerName)
 
-	} else if function == "confirm" {
-		//TODO: uncomment code below when SecurityContext will be propagated in cross chaincode requests
-		//if callerRole != "swiftagent" {
-		//	return nil, errors.New("Incorrect caller role. Expecting swiftagent.")
-		//}
-		if len(args) != 1 {
-			return nil, errors.New("Incorrect arguments. Expecting contractId")
+		// buyer settles in the bond's currency unless told otherwise
+		var currency string
+		if len(args) == 2 {
+			currency = args[1]
 		}
-		return t.confirm(stub, args[0])
 
-	} else if function == "payContractCoupon" {
-		//TODO: uncomment code below when SecurityContext will be propagated in cross chaincode requests
-		//if callerRole != "swiftagent" {
-		//	return nil, errors.New("Incorrect caller role. Expecting swiftagent.")
-		//}
-		if len(args) != 1 {
-			return nil, errors.New("Incorrect arguments. Expecting contractId")
+		// the investor's jurisdiction is needed for withholding on coupons
+		if err := t.saveMember(stub, member{Id: callerName, Role: callerRole, Company: callerCompany, Jurisdiction: callerJurisdiction}); err != nil {
+			return nil, err
 		}
-		_, err := t.payContractCoupon(stub, args[0])
-		return nil, err
-	} else if function == "sell" {
-		if callerRole != "investor" {
-			return nil, errors.New("Incorrect caller role. Expecting investor.")
+
+		return t.buy(stub, tradeId, callerName, callerCompany, currency)
+
+	} else if function == "confirm" || function == "payContractCoupon" || function == "payNettedCoupons" ||
+		function == "payFee" || function == "payWithholding" || function == "payRefund" {
+		// payment callbacks come from rails and are checked by the rail's signature, not by caller role
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting instructionId, amount, signature")
+		}
+		if err := t.verifyCallback(stub, function, args); err != nil {
+			return nil, err
+		}
+		amount, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect amount. Uint64 expected.")
+		}
+		return nil, t.paymentCallback(stub, function, args[0], amount)
+
+	} else if function == "paymentFailed" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting instructionId, reason, signature")
+		}
+		if err := t.verifyCallback(stub, function, args); err != nil {
+			return nil, err
 		}
+		return t.paymentFailed(stub, args[0], args[1])
+
+	} else if function == "paymentReversed" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting instructionId, signature")
+		}
+		if err := t.verifyCallback(stub, function, args); err != nil {
+			return nil, err
+		}
+		return t.paymentReversed(stub, args[0])
+
+	} else if function == "sell" {
 		if len(args) != 2 {
 			return nil, errors.New("Incorrect arguments. Expecting contractId, price.")
 		}
@@ -140,23 +292,191 @@ func (t *BondChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 			return nil, errors.New("Incorrect price. Uint64 expected.")
 		}
 
-		return t.sell(stub, args[0], price, callerName)
+		return t.sell(stub, args[0], price, callerName, callerCompany)
 
 	} else if function == "payCoupons" {
-		if callerRole != "system" {
-			return nil, errors.New("Incorrect caller role. Expecting system.")
-		}
 		if len(args) != 0 {
 			return nil, errors.New("Incorrect arguments. No arguments expected.")
 		}
 
 		t.removeExpiredBonds(stub)
+		if err := t.releaseExpiredTrades(stub); err != nil {
+			return nil, err
+		}
+		if err := t.checkCouponDefaults(stub); err != nil {
+			return nil, err
+		}
 		return t.payCoupons(stub)
 
-	} else if function == "setChainCodeId" {
-		if callerRole != "system" {
-			return nil, errors.New("Incorrect caller role. Expecting system.")
+	} else if function == "checkCouponDefaults" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. No arguments expected.")
+		}
+
+		return nil, t.checkCouponDefaults(stub)
+
+	} else if function == "setCouponNetting" {
+		if len(args) != 1 || (args[0] != "true" && args[0] != "false") {
+			return nil, errors.New("Incorrect arguments. Expecting true or false.")
 		}
+
+		return nil, stub.PutState("couponnetting", []byte(args[0]))
+
+	} else if function == "setGracePeriod" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting gracePeriod.")
+		}
+		if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+			return nil, errors.New("Incorrect gracePeriod. Uint64 expected.")
+		}
+
+		return nil, stub.PutState("graceperiod", []byte(args[0]))
+
+	} else if function == "setFeeSchedule" {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect arguments. Expecting tradeBps, tradeBeneficiary, placementBps, placementBeneficiary.")
+		}
+
+		tradeBps, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect tradeBps. Uint64 expected.")
+		}
+		placementBps, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect placementBps. Uint64 expected.")
+		}
+
+		return nil, t.setFeeSchedule(stub, feeSchedule{
+			TradeBps: 		tradeBps,
+			TradeBeneficiary: 	args[1],
+			PlacementBps: 		placementBps,
+			PlacementBeneficiary: 	args[3]})
+
+	} else if function == "setWithholdingRate" {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect arguments. Expecting issuerJurisdiction, investorJurisdiction, rateBps, authority.")
+		}
+
+		rateBps, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect rateBps. Uint64 expected.")
+		}
+
+		return nil, t.setWithholdingRate(stub, withholdingRate{
+			IssuerJurisdiction: 	args[0],
+			InvestorJurisdiction: 	args[1],
+			RateBps: 		rateBps,
+			Authority: 		args[3]})
+
+	} else if function == "releaseExpiredTrades" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. No arguments expected.")
+		}
+
+		return nil, t.releaseExpiredTrades(stub)
+
+	} else if function == "setPositionLimit" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting company, limit.")
+		}
+		limit, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect limit. Uint64 expected.")
+		}
+
+		return nil, t.setPositionLimit(stub, args[0], limit)
+
+	} else if function == "setConcentrationLimit" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting percent.")
+		}
+		percent, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect percent. Uint64 expected.")
+		}
+
+		return nil, t.setConcentrationLimit(stub, percent)
+
+	} else if function == "setExposureLimit" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting kind, name, limit.")
+		}
+		limit, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect limit. Uint64 expected.")
+		}
+
+		return nil, t.setExposureLimit(stub, args[0], args[1], limit)
+
+	} else if function == "setSettlementPeriod" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting settlementPeriod.")
+		}
+		if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+			return nil, errors.New("Incorrect settlementPeriod. Uint64 expected.")
+		}
+
+		return nil, stub.PutState("settlementperiod", []byte(args[0]))
+
+	} else if function == "openBidding" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId, commitEnd, revealEnd.")
+		}
+
+		commitEnd, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect commitEnd. Uint64 expected.")
+		}
+		revealEnd, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect revealEnd. Uint64 expected.")
+		}
+
+		return t.openBidding(stub, args[0], commitEnd, revealEnd, callerName)
+
+	} else if function == "commitBid" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId, hash.")
+		}
+
+		// the bidder's jurisdiction is needed when the bid is filled
+		if err := t.saveMember(stub, member{Id: callerName, Role: callerRole, Company: callerCompany, Jurisdiction: callerJurisdiction}); err != nil {
+			return nil, err
+		}
+
+		return t.commitBid(stub, args[0], args[1], callerName, callerCompany)
+
+	} else if function == "revealBid" {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId, price, quantity, salt.")
+		}
+
+		price, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect price. Uint64 expected.")
+		}
+		quantity, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect quantity. Uint64 expected.")
+		}
+
+		return t.revealBid(stub, args[0], price, quantity, args[3], callerName)
+
+	} else if function == "closeBidding" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId.")
+		}
+
+		return t.closeBidding(stub, args[0], callerName)
+
+	} else if function == "hitBid" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId, bidderId.")
+		}
+
+		return t.hitBid(stub, args[0], args[1], callerName, callerCompany)
+
+	} else if function == "setChainCodeId" {
 		if len(args) != 1 {
 			return nil, errors.New("Incorrect arguments. Expecting chaincodeID.")
 		}
@@ -164,6 +484,150 @@ func (t *BondChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 
 		return nil, error
 
+	} else if function == "deposit" || function == "withdraw" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting memberId, currency, amount.")
+		}
+
+		amount, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect amount. Uint64 expected.")
+		}
+
+		if function == "deposit" {
+			return t.deposit(stub, args[0], args[1], amount)
+		}
+		return t.withdraw(stub, args[0], args[1], amount)
+
+	} else if function == "transfer" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting payeeId, currency, amount.")
+		}
+
+		amount, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect amount. Uint64 expected.")
+		}
+
+		return t.transfer(stub, callerName, args[0], args[1], amount)
+
+	} else if function == "setPaymentChaincode" {
+		return nil, t.setPaymentChaincode(stub, "paymentchaincode", args)
+
+	} else if function == "setTokenChaincode" {
+		return nil, t.setPaymentChaincode(stub, "tokenchaincode", args)
+
+	} else if function == "setRailKey" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting rail, PEM encoded public key.")
+		}
+
+		return nil, t.setRailKey(stub, args[0], args[1])
+
+	} else if function == "setPaymentRail" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting scope (bond or currency), bondId or currency, rail.")
+		}
+
+		return nil, t.setPaymentRail(stub, args[0], args[1], args[2])
+
+	} else if function == "grantPermission" {
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting function, role and optional capability.")
+		}
+
+		permission_ := permission{Function: args[0], Role: args[1]}
+		if len(args) == 3 {
+			permission_.Capability = args[2]
+		}
+		return nil, t.grantPermission(stub, permission_)
+
+	} else if function == "revokePermission" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting function, role.")
+		}
+
+		return nil, t.revokePermission(stub, args[0], args[1])
+
+	} else if function == "grantCapability" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting memberId, capability.")
+		}
+
+		return nil, t.grantCapability(stub, args[0], args[1])
+
+	} else if function == "revokeCapability" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting memberId, capability.")
+		}
+
+		return nil, t.revokeCapability(stub, args[0], args[1])
+
+	} else if function == "whitelistInvestor" {
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect arguments. Expecting investorId, category, expiry.")
+		}
+		expiry, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect expiry. Uint64 expected.")
+		}
+
+		return t.whitelistInvestor(stub, args[0], args[1], expiry, callerName)
+
+	} else if function == "delistInvestor" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting investorId.")
+		}
+
+		return t.delistInvestor(stub, args[0])
+
+	} else if function == "publishSanctions" {
+		if len(args) < 1 {
+			return nil, errors.New("Incorrect arguments. Expecting version and hashes.")
+		}
+		version, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect version. Uint64 expected.")
+		}
+
+		return t.publishSanctions(stub, version, args[1:])
+
+	} else if function == "releaseHeldTrade" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting tradeId.")
+		}
+		tradeId, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect tradeId. Uint64 expected.")
+		}
+
+		return t.releaseHeldTrade(stub, tradeId)
+
+	} else if function == "releaseHeldPayment" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting instructionId.")
+		}
+
+		return t.releaseHeldPayment(stub, args[0])
+
+	} else if function == "rejectHeldPayment" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting instructionId, reason.")
+		}
+
+		return t.rejectHeldPayment(stub, args[0], args[1])
+
+	} else if function == "rejectHeldTrade" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect arguments. Expecting tradeId, reason.")
+		}
+		tradeId, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("Incorrect tradeId. Uint64 expected.")
+		}
+
+		return t.rejectHeldTrade(stub, tradeId, args[1])
+
 	} else {
 		log.Errorf("function: %s, args: %s", function, args)
 		return nil, errors.New("Received unknown function invocation")
@@ -179,14 +643,15 @@ func (t *BondChaincode) Query(stub shim.ChaincodeStubInterface, function string,
 	role := t.getCallerRole(stub)
 	user := t.getCallerName(stub)
 
+	if err := t.checkPermission(stub, function, user, role); err != nil {
+		return nil, err
+	}
+
 	// Handle different functions
 	if function == "getBonds" {
 		if len(args) != 0 {
 			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
 		}
-		if role != "issuer" {
-			return nil, errors.New("Incorrect caller role. Expecting issuer.")
-		}
 
 		bonds, err := t.getBonds(stub, user)
 		if err != nil {
@@ -207,7 +672,14 @@ func (t *BondChaincode) Query(stub shim.ChaincodeStubInterface, function string,
 			return json.Marshal(contracts)
 
 		} else if role == "investor" {
-			contracts, err := t.getOwnerContracts(stub, user)
+			// users of a company see the whole firm's book
+			var contracts []contract
+			var err error
+			if company := t.getCallerCompany(stub); company != "" {
+				contracts, err = t.getCompanyContracts(stub, company)
+			} else {
+				contracts, err = t.getOwnerContracts(stub, user)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -239,10 +711,339 @@ func (t *BondChaincode) Query(stub shim.ChaincodeStubInterface, function string,
 				return nil, err
 			}
 
+			return json.Marshal(trades)
+		} else if role == "compliance" {
+			trades, err := t.getTradesByType(stub, "held")
+			if err != nil {
+				return nil, err
+			}
+
 			return json.Marshal(trades)
 		} else {
+			return nil, errors.New("Incorrect caller role. Expecting investor, auditor or compliance.")
+		}
+	} else if function == "getContractHistory" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting contractId.")
+		}
+
+		history, err := t.getContractHistory(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if role == "issuer" {
+			// contract ids are prefixed with their issuer id and outlive archived contracts
+			if strings.Split(args[0], ".")[0] != user {
+				return nil, errors.New("Only issuer of the contract can query its history")
+			}
+		} else if role == "investor" {
+			party := false
+			for _, event := range history {
+				if event.SellerId == user || event.BuyerId == user {
+					party = true
+					break
+				}
+			}
+			if !party {
+				return nil, errors.New("Only parties to the contract's trades can query its history")
+			}
+		} else if role != "auditor" {
+			return nil, errors.New("Incorrect caller role. Expecting investor, issuer or auditor.")
+		}
+
+		return json.Marshal(history)
+
+	} else if function == "getDefaults" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		defaults, err := t.getDefaults(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(defaults)
+
+	} else if function == "getPayments" {
+		if len(args) > 2 {
+			return nil, errors.New("Incorrect arguments. Expecting optional memberId and status.")
+		}
+
+		var memberId, status string
+		if len(args) > 0 {
+			memberId = args[0]
+		}
+		if len(args) > 1 {
+			status = args[1]
+		}
+
+		if role == "investor" || role == "issuer" {
+			if memberId != "" && memberId != user {
+				return nil, errors.New("Only auditor can query payments of other members")
+			}
+			memberId = user
+		} else if role != "auditor" && role != "system" && role != "bank" && role != "compliance" {
+			return nil, errors.New("Incorrect caller role. Expecting investor, issuer, auditor, system, bank or compliance.")
+		}
+
+		payments, err := t.getPayments(stub, memberId, status)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(payments)
+
+	} else if function == "getFeeSchedule" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		schedule, err := t.getFeeSchedule(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(schedule)
+
+	} else if function == "getFees" {
+		if len(args) > 1 {
+			return nil, errors.New("Incorrect arguments. Expecting optional memberId.")
+		}
+
+		var memberId string
+		if len(args) > 0 {
+			memberId = args[0]
+		}
+
+		fees, err := t.getFees(stub, memberId)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(fees)
+
+	} else if function == "getWithholdings" {
+		if len(args) > 2 {
+			return nil, errors.New("Incorrect arguments. Expecting optional investorId and year.")
+		}
+
+		var investorId string
+		var year uint64
+		if len(args) > 0 {
+			investorId = args[0]
+		}
+		if len(args) > 1 {
+			var err error
+			year, err = strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return nil, errors.New("Incorrect year. Uint64 expected.")
+			}
+		}
+
+		if role == "investor" {
+			if investorId != "" && investorId != user {
+				return nil, errors.New("Only auditor can query withholdings of other investors")
+			}
+			investorId = user
+		} else if role != "auditor" {
 			return nil, errors.New("Incorrect caller role. Expecting investor or auditor.")
 		}
+
+		withholdings, err := t.getWithholdings(stub, investorId, year)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(withholdings)
+
+	} else if function == "getWithholdingRates" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		rates, err := t.getWithholdingRates(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(rates)
+
+	} else if function == "getBalances" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		var balances []balance
+		var err error
+		if role == "auditor" || role == "custodian" {
+			balances, err = t.getBalances(stub, "")
+		} else if role == "investor" || role == "issuer" {
+			balances, err = t.getBalances(stub, user)
+		} else {
+			return nil, errors.New("Incorrect caller role. Expecting investor, issuer, custodian or auditor.")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(balances)
+
+	} else if function == "getPaymentChaincode" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		paymentChaincode_, err := t.getPaymentChaincode(stub, "paymentchaincode")
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(paymentChaincode_)
+
+	} else if function == "getBids" {
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect arguments. Expecting bondId.")
+		}
+
+		var bids []bid
+		var err error
+		if role == "auditor" {
+			bids, err = t.getBids(stub, args[0], "")
+		} else if role == "issuer" {
+			if _, err := t.getBond(stub, user, args[0]); err != nil {
+				return nil, errors.New("Only issuer of the bond can query its bids")
+			}
+			bids, err = t.getBids(stub, args[0], "")
+		} else if role == "investor" {
+			bids, err = t.getBids(stub, args[0], user)
+		} else {
+			return nil, errors.New("Incorrect caller role. Expecting investor, issuer or auditor.")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(bids)
+
+	} else if function == "getProposals" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		var proposals []proposal
+		var err error
+		if role == "auditor" {
+			proposals, err = t.getProposals(stub, "", "")
+		} else if role == "issuer" {
+			company := t.getCallerCompany(stub)
+			if company == "" {
+				return nil, errors.New("Only issuers of a company can query its proposals")
+			}
+			proposals, err = t.getProposals(stub, company, "")
+		} else {
+			proposals, err = t.getProposals(stub, "", user)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(proposals)
+
+	} else if function == "getPermissions" {
+		if len(args) > 1 {
+			return nil, errors.New("Incorrect arguments. Expecting optional function.")
+		}
+
+		var function_ string
+		if len(args) > 0 {
+			function_ = args[0]
+		}
+
+		permissions, err := t.getPermissions(stub, function_)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(permissions)
+
+	} else if function == "getCapabilities" {
+		if len(args) > 1 {
+			return nil, errors.New("Incorrect arguments. Expecting optional memberId.")
+		}
+
+		var memberId string
+		if len(args) > 0 {
+			memberId = args[0]
+		}
+		if role != "system" && role != "auditor" {
+			if memberId != "" && memberId != user {
+				return nil, errors.New("Only system or auditor can query capabilities of other members")
+			}
+			memberId = user
+		}
+
+		capabilities, err := t.getCapabilities(stub, memberId)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(capabilities)
+
+	} else if function == "getLimitUtilization" {
+		if len(args) > 1 {
+			return nil, errors.New("Incorrect arguments. Expecting optional investorId.")
+		}
+
+		investorId := user
+		if len(args) > 0 {
+			investorId = args[0]
+		}
+		if investorId != user && role != "auditor" && role != "compliance" {
+			return nil, errors.New("Only auditor or compliance can query limits of other investors")
+		}
+
+		utilization, err := t.getLimitUtilization(stub, investorId)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(utilization)
+
+	} else if function == "getWhitelist" {
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect arguments. Expecting no arguments.")
+		}
+
+		clearances, err := t.getWhitelist(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(clearances)
+
+	} else if function == "getIneligibleHoldings" {
+		if len(args) > 1 {
+			return nil, errors.New("Incorrect arguments. Expecting optional asOf.")
+		}
+
+		// queries carry no transaction timestamp, eligibility is checked as of now by default
+		asOf := uint64(time.Now().Unix())
+		if len(args) > 0 {
+			var err error
+			if asOf, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+				return nil, errors.New("Incorrect asOf. Uint64 expected.")
+			}
+		}
+
+		holdings, err := t.getIneligibleHoldings(stub, asOf)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(holdings)
+
 	} else {
 		log.Errorf("function: %s, args: %s", function, args)
 		return nil, errors.New("Received unknown function invocation")
@@ -264,6 +1065,15 @@ func (t *BondChaincode) incrementAndGetCounter(stub shim.ChaincodeStubInterface,
 	return result, err
 }
 
+func (t *BondChaincode) getTxTime(stub shim.ChaincodeStubInterface) (uint64, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		log.Error("Failed retrieving transaction timestamp. Error: " + err.Error())
+		return 0, err
+	}
+	return uint64(timestamp.Seconds), nil
+}
+
 func (t *BondChaincode) getCallerAttribute(stub shim.ChaincodeStubInterface, attr string) (string) {
 	value, err := stub.ReadCertAttribute(attr)
 	if err != nil {
@@ -278,6 +1088,10 @@ func (t *BondChaincode) getCallerCompany(stub shim.ChaincodeStubInterface) (stri
 	return t.getCallerAttribute(stub, "company")
 }
 
+func (t *BondChaincode) getCallerJurisdiction(stub shim.ChaincodeStubInterface) (string) {
+	return t.getCallerAttribute(stub, "jurisdiction")
+}
+
 func (t *BondChaincode) getCallerName(stub shim.ChaincodeStubInterface) (string) {
 	return t.getCallerAttribute(stub, "name")
 }
@@ -7,6 +7,9 @@ import (
 	"fmt"
 )
 
+// seconds between coupon payments, coupons are paid monthly
+const COUPON_PERIOD uint64 = 30 * 86400
+
 type bond struct {
 	IssuerId       string `json:"issuerId"`
 	Id             string `json:"id"`
@@ -17,6 +20,26 @@ type bond struct {
 	Trigger        string `json:"trigger"`
 	State          string `json:"state"`
 	CouponsPaid    uint64 `json:"couponsPaid"`
+	CouponsDue     uint64 `json:"couponsDue"`
+	Currency       string `json:"currency"`
+	LastCouponDate uint64 `json:"lastCouponDate"`
+	Region         string `json:"region"`
+}
+
+func (bond_ *bond) readFromRow(row shim.Row) {
+	bond_.IssuerId 		= row.Columns[0].GetString_()
+	bond_.Id 		= row.Columns[1].GetString_()
+	bond_.Principal 	= row.Columns[2].GetUint64()
+	bond_.Term 		= row.Columns[3].GetUint64()
+	bond_.MaturityDate 	= row.Columns[4].GetString_()
+	bond_.Rate 		= row.Columns[5].GetUint64()
+	bond_.Trigger 		= row.Columns[6].GetString_()
+	bond_.State 		= row.Columns[7].GetString_()
+	bond_.CouponsPaid 	= row.Columns[8].GetUint64()
+	bond_.CouponsDue 	= row.Columns[9].GetUint64()
+	bond_.Currency 		= row.Columns[10].GetString_()
+	bond_.LastCouponDate 	= row.Columns[11].GetUint64()
+	bond_.Region 		= row.Columns[12].GetString_()
 }
 
 func (bond_ *bond) toRow() (shim.Row) {
@@ -30,7 +53,11 @@ func (bond_ *bond) toRow() (shim.Row) {
 			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.Rate}},
 			&shim.Column{Value: &shim.Column_String_{String_: bond_.Trigger}},
 			&shim.Column{Value: &shim.Column_String_{String_: bond_.State}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.CouponsPaid}}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.CouponsPaid}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.CouponsDue}},
+			&shim.Column{Value: &shim.Column_String_{String_: bond_.Currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.LastCouponDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: bond_.Region}}},
 	}
 }
 
@@ -48,6 +75,10 @@ func (t *BondChaincode) initBonds(stub shim.ChaincodeStubInterface) (error) {
 		&shim.ColumnDefinition{Name: "Trigger", Type: shim.ColumnDefinition_STRING, Key: false},
 		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
 		&shim.ColumnDefinition{Name: "CouponsPaid", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "CouponsDue", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "LastCouponDate", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Region", Type: shim.ColumnDefinition_STRING, Key: false},
 	})
 	if err != nil {
 		log.Criticalf("Cannot initialize Bonds")
@@ -74,16 +105,8 @@ func (t *BondChaincode) getBonds(stub shim.ChaincodeStubInterface, issuerID stri
 	var bonds []bond
 
 	for row := range rows {
-		result := bond{
-			IssuerId:       row.Columns[0].GetString_(),
-			Id:             row.Columns[1].GetString_(),
-			Principal:      row.Columns[2].GetUint64(),
-			Term:           row.Columns[3].GetUint64(),
-			MaturityDate:   row.Columns[4].GetString_(),
-			Rate:           row.Columns[5].GetUint64(),
-			Trigger:        row.Columns[6].GetString_(),
-			State:          row.Columns[7].GetString_(),
-			CouponsPaid:    row.Columns[8].GetUint64()}
+		var result bond
+		result.readFromRow(row)
 
 		log.Debugf("getBonds result includes: %+v", result)
 		bonds = append(bonds, result)
@@ -137,17 +160,12 @@ func (t *BondChaincode) getBond(stub shim.ChaincodeStubInterface, issuerID strin
 		log.Error(message)
 		return bond{}, errors.New(message)
 	}
+	if len(row.Columns) == 0 {
+		return bond{}, errors.New("No bond found for id " + bondId)
+	}
 
-	result := bond{
-		IssuerId:       row.Columns[0].GetString_(),
-		Id:             row.Columns[1].GetString_(),
-		Principal:      row.Columns[2].GetUint64(),
-		Term:           row.Columns[3].GetUint64(),
-		MaturityDate:   row.Columns[4].GetString_(),
-		Rate:           row.Columns[5].GetUint64(),
-		Trigger:        row.Columns[6].GetString_(),
-		State:          row.Columns[7].GetString_(),
-		CouponsPaid:    row.Columns[8].GetUint64()}
+	var result bond
+	result.readFromRow(row)
 
 	log.Debugf("getBonds result includes: %+v", result)
 
@@ -155,20 +173,17 @@ func (t *BondChaincode) getBond(stub shim.ChaincodeStubInterface, issuerID strin
 }
 
 func (t *BondChaincode) createBond(stub shim.ChaincodeStubInterface, bond_ bond) ([]byte, error) {
-	//TODO Verify if bond with such id is created already
+	// interest accrues from issuance until the first coupon
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	bond_.LastCouponDate = now
 
-	if ok, err := stub.InsertRow("Bonds", shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: bond_.IssuerId}},
-			&shim.Column{Value: &shim.Column_String_{String_: bond_.Id}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.Principal}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.Term}},
-			&shim.Column{Value: &shim.Column_String_{String_: bond_.MaturityDate}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.Rate}},
-			&shim.Column{Value: &shim.Column_String_{String_: bond_.Trigger}},
-			&shim.Column{Value: &shim.Column_String_{String_: bond_.State}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: bond_.CouponsPaid}}},
-	}); !ok {
+	if ok, err := stub.InsertRow("Bonds", bond_.toRow()); !ok {
+		if err == nil {
+			err = errors.New("Bond " + bond_.Id + " is issued already")
+		}
 		log.Error("Failed inserting new bond: " + err.Error())
 		return nil, err
 	}
@@ -186,11 +201,13 @@ func (t *BondChaincode) payCoupons(stub shim.ChaincodeStubInterface) ([]byte, er
 		return nil, err
 	}
 
-	// Iterate over the contracts and increment those that match bondId
-	matchCounter := 0
+	// Collect coupons due on active contracts, those of investor contracts
+	// reserved in a pending trade are deferred until the trade is done
+	var coupons []couponAllocation
+	var withholdings []withholding
 	for _, contract_ := range contracts {
 		// "issuer0.2017.6.13.600" expected after trimming a suffix from "issuer0.2017.6.13.600.42"
-		if contract_.State=="active"  {
+		if contract_.State=="active" || (contract_.State=="reserved" && contract_.OwnerId != contract_.IssuerId) {
 			bondId := contract_.Id[:strings.LastIndex(contract_.Id, ".")]
 			log.Debugf("try to load bond with id %s ", bondId)
 			bond, err := t.getBond(stub, contract_.IssuerId, bondId)
@@ -199,24 +216,102 @@ func (t *BondChaincode) payCoupons(stub shim.ChaincodeStubInterface) ([]byte, er
 				log.Error("cannot load bond for contract: " + err.Error())
 				continue
 			}
-			var price uint64;
-			if bond.Term == bond.CouponsPaid + 1 {
-				price = PRICE_PER_CONTRACT  + uint64((float64(PRICE_PER_CONTRACT) / 100.0 ) * (float64(bond.Rate) / 100.0 / 12.0))
+			if bond.CouponsDue >= bond.Term {
+				continue
+			}
+			coupon := couponAllocation{
+				ContractId: 	contract_.Id,
+				BondId: 	bondId,
+				Payer: 		contract_.IssuerId,
+				Payee: 		contract_.OwnerId,
+				Currency: 	bond.Currency,
+				Amount: 	bond.getCoupon()}
+			// the investor is owed the coupon net of withholding tax
+			withholding_, err := t.withholdCoupon(stub, &coupon)
+			if err != nil {
+				return nil, err
+			}
+			if withholding_.Withheld > 0 {
+				withholdings = append(withholdings, withholding_)
+			}
+			// the principal is paid back with the last coupon, tax is withheld on the coupon only
+			if bond.Term == bond.CouponsDue + 1 {
+				coupon.Amount += PRICE_PER_CONTRACT
+			}
+			// the coupon is owed whether or not the instruction goes out and
+			// before rails that settle right away call payContractCoupon
+			if err := t.accrueArrears(stub, contract_.Id, coupon.Amount); err != nil {
+				return nil, err
+			}
+			if contract_.State == "reserved" {
+				if err := t.deferCoupon(stub, coupon); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			coupons = append(coupons, coupon)
+		}
+	}
 
-			}else{
-				price = uint64((float64(PRICE_PER_CONTRACT) / 100.0 ) * (float64(bond.Rate) / 100.0 / 12.0))
+	netting, err := t.isCouponNetting(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	matchCounter := 0
+	if netting {
+		matchCounter, err = t.submitNettedCoupons(stub, coupons)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, coupon := range coupons {
+			_, err = t.submitPayment(stub, coupon.BondId, coupon.Currency, paymentInstruction{
+				Payer: 		coupon.Payer,
+				Payee: 		coupon.Payee,
+				Amount: 	coupon.Amount,
+				Purpose: 	"coupon",
+				Reference: 	coupon.ContractId,
+				Callback: 	"payContractCoupon"})
+			if err != nil {
+				log.Error("cannot submit coupon payment for contract " + coupon.ContractId + ": " + err.Error())
+				continue
 			}
-			t.submitPaymentInstruction(stub, contract_.IssuerId, contract_.OwnerId, price, "coupon", contract_.Id, "payContractCoupon", contract_.Id)
+			matchCounter++
 		}
 	}
-	log.Debugf("couponsPaid: %d out of %d i were paid",
-		matchCounter, len(contracts))
+	log.Debugf("couponsPaid: %d instructions were submitted for %d coupons of %d contracts",
+		matchCounter, len(coupons), len(contracts))
 
-	t.recordCouponPayment(stub)
+	if err := t.submitWithholdings(stub, withholdings); err != nil {
+		return nil, err
+	}
+
+	if err := t.recordCouponPeriod(stub); err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
 
+// getCoupon returns the monthly coupon paid on a contract of the bond.
+func (bond_ *bond) getCoupon() (uint64) {
+	return uint64((float64(PRICE_PER_CONTRACT) / 100.0 ) * (float64(bond_.Rate) / 100.0 / 12.0))
+}
+
+// getAccruedInterest returns the coupon accrued on a contract of the bond
+// since its last coupon date, pro rata over the coupon period.
+func (bond_ *bond) getAccruedInterest(now uint64) (uint64) {
+	if now <= bond_.LastCouponDate {
+		return 0
+	}
+	elapsed := now - bond_.LastCouponDate
+	if elapsed >= COUPON_PERIOD {
+		return bond_.getCoupon()
+	}
+	return bond_.getCoupon() * elapsed / COUPON_PERIOD
+}
+
 func (t *BondChaincode) removeExpiredBonds(stub shim.ChaincodeStubInterface) (error) {
 	log.Debugf("removeExpiredBonds called ")
 
@@ -243,20 +338,34 @@ func (t *BondChaincode) removeExpiredBonds(stub shim.ChaincodeStubInterface) (er
 	return nil
 }
 
-func (t *BondChaincode) recordCouponPayment(stub shim.ChaincodeStubInterface) (error) {
-	log.Debugf("recordCouponPayment called ")
+// recordCouponPeriod counts a coupon period as due on every bond. The period
+// counts as paid only once no contract of the bond is in arrears.
+func (t *BondChaincode) recordCouponPeriod(stub shim.ChaincodeStubInterface) (error) {
+	log.Debugf("recordCouponPeriod called ")
 
 	// Get all bonds
 	bonds, err := t.getBonds(stub, "")
 	if err != nil {
-		log.Error("recordCouponPayment failed on retrieving bonds: " + err.Error())
+		log.Error("recordCouponPeriod failed on retrieving bonds: " + err.Error())
+		return err
+	}
+
+	now, err := t.getTxTime(stub)
+	if err != nil {
 		return err
 	}
 
 	for _, bond_ := range bonds {
-		bond_.CouponsPaid = bond_.CouponsPaid + 1
+		if bond_.CouponsDue >= bond_.Term {
+			continue
+		}
+		bond_.CouponsDue = bond_.CouponsDue + 1
+		bond_.LastCouponDate = now
 		if ok, err := stub.ReplaceRow("Bonds", bond_.toRow()); !ok {
-			log.Error("Failed inserting CouponsPaid number: " + err.Error())
+			log.Error("Failed inserting CouponsDue number: " + err.Error())
+			return err
+		}
+		if err := t.refreshBondPayments(stub, bond_.IssuerId, bond_.Id); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// The security context of a rail calling back through a cross chaincode
+// request is not propagated, so callbacks cannot be checked by caller role.
+// Instead each rail calling back from outside the transaction registers an
+// ECDSA public key and signs every callback. The signature is the last
+// argument of the callback and covers "function|arg1|arg2...", the function
+// name and the arguments before it, so that a signed confirmation cannot be
+// replayed as another callback. The signature must come from the key of the
+// rail the instruction was submitted over.
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (t *BondChaincode) setRailKey(stub shim.ChaincodeStubInterface, railName string, keyPem string) (error) {
+	if _, err := t.newPaymentRail(railName); err != nil {
+		return err
+	}
+	if _, err := parseRailKey([]byte(keyPem)); err != nil {
+		return err
+	}
+	log.Debugf("setRailKey for %s", railName)
+	return stub.PutState("railkey." + railName, []byte(keyPem))
+}
+
+func parseRailKey(keyPem []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, errors.New("Incorrect rail key. PEM encoded public key expected.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Incorrect rail key. Error: " + err.Error())
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Incorrect rail key. ECDSA public key expected.")
+	}
+	return ecdsaKey, nil
+}
+
+// verifyCallback checks the last of args is the signature by the rail of the
+// instruction in args[0] over the function and the other args.
+func (t *BondChaincode) verifyCallback(stub shim.ChaincodeStubInterface, function string, args []string) (error) {
+	if len(args) < 2 {
+		return errors.New("Incorrect arguments. Expecting instructionId and signature.")
+	}
+
+	instruction, err := t.getPayment(stub, args[0])
+	if err != nil {
+		return err
+	}
+	keyPem, err := stub.GetState("railkey." + instruction.Rail)
+	if err != nil {
+		return err
+	}
+	if len(keyPem) == 0 {
+		return errors.New("No key registered for " + instruction.Rail + " rail to call back " + function)
+	}
+	key, err := parseRailKey(keyPem)
+	if err != nil {
+		return err
+	}
+
+	signatureBytes, err := hex.DecodeString(args[len(args) - 1])
+	if err != nil {
+		return errors.New("Incorrect signature. Hex encoded signature expected.")
+	}
+	var signature ecdsaSignature
+	if _, err := asn1.Unmarshal(signatureBytes, &signature); err != nil || signature.R == nil || signature.S == nil {
+		return errors.New("Incorrect signature. ASN.1 encoded ECDSA signature expected.")
+	}
+
+	message := function + "|" + strings.Join(args[:len(args) - 1], "|")
+	digest := sha256.Sum256([]byte(message))
+	if !ecdsa.Verify(key, digest[:], signature.R, signature.S) {
+		log.Errorf("verifyCallback rejected %s for instruction %s", function, args[0])
+		return errors.New("Callback " + function + " is not signed by " + instruction.Rail + " rail")
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"strconv"
+)
+
+// Cash tokens are on-ledger balances per member and currency. A custodian
+// deposits and withdraws them against fiat held off-ledger, members transfer
+// them and the cash rail uses them to settle in the same transaction.
+
+const DEFAULT_CURRENCY = "USD"
+
+// isCurrencyCode checks the currency is an ISO 4217 alphabetic code.
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, letter := range currency {
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+type balance struct {
+	OwnerId  string `json:"ownerId"`
+	Currency string `json:"currency"`
+	Amount   uint64 `json:"amount"`
+}
+
+func (balance_ *balance) readFromRow(row shim.Row) {
+	balance_.OwnerId 	= row.Columns[0].GetString_()
+	balance_.Currency 	= row.Columns[1].GetString_()
+	balance_.Amount 	= row.Columns[2].GetUint64()
+}
+
+func (balance_ *balance) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: balance_.OwnerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: balance_.Currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: balance_.Amount}}},
+	}
+}
+
+func (t *BondChaincode) initBalances(stub shim.ChaincodeStubInterface) (error) {
+	// Create balances table
+	err := stub.CreateTable("Balances", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "OwnerId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Balances")
+		return errors.New("Failed creating Balances table.")
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) getBalance(stub shim.ChaincodeStubInterface, ownerId string, currency string) (balance, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: ownerId}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: currency}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("Balances", columns)
+	if err != nil {
+		message := "Failed retrieving balance. Error: " + err.Error()
+		log.Error(message)
+		return balance{}, errors.New(message)
+	}
+
+	result := balance{OwnerId: ownerId, Currency: currency}
+	if len(row.Columns) != 0 {
+		result.readFromRow(row)
+	}
+	return result, nil
+}
+
+func (t *BondChaincode) saveBalance(stub shim.ChaincodeStubInterface, balance_ balance) (error) {
+	log.Debugf("saveBalance: %+v", balance_)
+
+	ok, err := stub.InsertRow("Balances", balance_.toRow())
+	if err != nil {
+		log.Error("Failed inserting balance: " + err.Error())
+		return err
+	}
+	if !ok {
+		if _, err := stub.ReplaceRow("Balances", balance_.toRow()); err != nil {
+			log.Error("Failed replacing balance: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCashAmount validates the currency and amount moved by deposit, withdraw and transfer.
+func checkCashAmount(currency string, amount uint64) (error) {
+	if !isCurrencyCode(currency) {
+		return errors.New("Incorrect currency. ISO 4217 code expected.")
+	}
+	if amount == 0 {
+		return errors.New("Incorrect amount. Expecting an amount above 0.")
+	}
+	return nil
+}
+
+func (t *BondChaincode) deposit(stub shim.ChaincodeStubInterface, ownerId string, currency string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s, %d", "deposit", ownerId, currency, amount)
+
+	if err := checkCashAmount(currency, amount); err != nil {
+		return nil, err
+	}
+
+	balance_, err := t.getBalance(stub, ownerId, currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance_.Amount + amount < balance_.Amount {
+		return nil, errors.New("Deposit of " + strconv.FormatUint(amount, 10) + " overflows " + currency + " balance of " + ownerId)
+	}
+	balance_.Amount += amount
+
+	return nil, t.saveBalance(stub, balance_)
+}
+
+func (t *BondChaincode) withdraw(stub shim.ChaincodeStubInterface, ownerId string, currency string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s, %d", "withdraw", ownerId, currency, amount)
+
+	if err := checkCashAmount(currency, amount); err != nil {
+		return nil, err
+	}
+
+	balance_, err := t.getBalance(stub, ownerId, currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance_.Amount < amount {
+		return nil, errors.New("Insufficient " + currency + " balance of " + ownerId)
+	}
+	balance_.Amount -= amount
+
+	return nil, t.saveBalance(stub, balance_)
+}
+
+func (t *BondChaincode) transfer(stub shim.ChaincodeStubInterface, payerId string, payeeId string, currency string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s, %s, %d", "transfer", payerId, payeeId, currency, amount)
+
+	if payerId == payeeId {
+		return nil, errors.New("Payer and payee must differ")
+	}
+	if err := checkCashAmount(currency, amount); err != nil {
+		return nil, err
+	}
+
+	payer, err := t.getBalance(stub, payerId, currency)
+	if err != nil {
+		return nil, err
+	}
+	if payer.Amount < amount {
+		return nil, errors.New("Insufficient " + currency + " balance of " + payerId + " to pay " + strconv.FormatUint(amount, 10))
+	}
+	payee, err := t.getBalance(stub, payeeId, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	if payee.Amount + amount < payee.Amount {
+		return nil, errors.New("Transfer of " + strconv.FormatUint(amount, 10) + " overflows " + currency + " balance of " + payeeId)
+	}
+
+	payer.Amount -= amount
+	payee.Amount += amount
+	if err := t.saveBalance(stub, payer); err != nil {
+		return nil, err
+	}
+
+	return nil, t.saveBalance(stub, payee)
+}
+
+func (t *BondChaincode) getBalances(stub shim.ChaincodeStubInterface, ownerId string) (balances []balance, err error) {
+	var columns []shim.Column
+	if ownerId != "" {
+		columnOwnerId := shim.Column{Value: &shim.Column_String_{String_: ownerId}}
+		columns = append(columns, columnOwnerId)
+	}
+
+	rows, err := stub.GetRows("Balances", columns)
+	if err != nil {
+		message := "Failed retrieving balances. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result balance
+		result.readFromRow(row)
+		balances = append(balances, result)
+	}
+
+	return balances, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"strconv"
+)
+
+// Contracts are held at company level: OwnerCompany is the firm a contract is
+// booked to and OwnerId the user who booked it and is paid its coupons. Users
+// of the owner company act for it and may sell its contracts. A company may
+// hold no more contracts than the position limit set for it.
+
+func (t *BondChaincode) setPositionLimit(stub shim.ChaincodeStubInterface, company string, limit uint64) (error) {
+	if company == "" {
+		return errors.New("Incorrect company. Expecting company name.")
+	}
+	log.Debugf("setPositionLimit: %s %d", company, limit)
+	return stub.PutState("positionlimit." + company, []byte(strconv.FormatUint(limit, 10)))
+}
+
+// getPositionLimit returns false if no limit is set for the company.
+func (t *BondChaincode) getPositionLimit(stub shim.ChaincodeStubInterface, company string) (uint64, bool, error) {
+	limitBytes, err := stub.GetState("positionlimit." + company)
+	if err != nil {
+		log.Error("Failed retrieving position limit. Error: " + err.Error())
+		return 0, false, err
+	}
+	if len(limitBytes) == 0 {
+		return 0, false, nil
+	}
+	limit, err := strconv.ParseUint(string(limitBytes), 10, 64)
+	return limit, true, err
+}
+
+// canActForOwner lets the owner of a contract or a user of its owner company act on it.
+func canActForOwner(contract_ contract, callerName string, callerCompany string) (bool) {
+	return callerName == contract_.OwnerId || (callerCompany != "" && callerCompany == contract_.OwnerCompany)
+}
+
+func (t *BondChaincode) getCompanyContracts(stub shim.ChaincodeStubInterface, company string) (contracts []contract, err error) {
+	allContracts, err := t.getAllContracts(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, contract_ := range allContracts {
+		if contract_.OwnerCompany == company {
+			contracts = append(contracts, contract_)
+		}
+	}
+
+	return contracts, nil
+}
+
+// getCompanyPosition counts the contracts the company holds or is buying.
+func (t *BondChaincode) getCompanyPosition(stub shim.ChaincodeStubInterface, company string) (uint64, error) {
+	contracts, err := t.getCompanyContracts(stub, company)
+	if err != nil {
+		return 0, err
+	}
+	pending, err := t.getPendingTrades(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	position := uint64(len(contracts))
+	for _, trade_ := range pending {
+		if trade_.BuyerCompany == company {
+			position++
+		}
+	}
+	return position, nil
+}
+
+func (t *BondChaincode) checkPositionLimit(stub shim.ChaincodeStubInterface, company string) (error) {
+	if company == "" {
+		return nil
+	}
+	limit, ok, err := t.getPositionLimit(stub, company)
+	if err != nil || !ok {
+		return err
+	}
+	position, err := t.getCompanyPosition(stub, company)
+	if err != nil {
+		return err
+	}
+	if position >= limit {
+		return rejectTrade("POSITION_LIMIT", "Company " + company + " holds " + strconv.FormatUint(position, 10) + " contracts, its limit is " + strconv.FormatUint(limit, 10))
+	}
+	return nil
+}
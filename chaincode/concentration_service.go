@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An investor may hold no more than the concentration limit, a percentage of
+// the contracts of a bond, and no more principal of bonds exposed to a peril
+// or a region than the exposure limit set for it. The peril of a bond is its
+// trigger. Contracts the investor is buying count as held. Limits not set are
+// not enforced.
+
+type bondUtilization struct {
+	BondId    string `json:"bondId"`
+	Contracts uint64 `json:"contracts"`
+	Percent   uint64 `json:"percent"`
+	Limit     uint64 `json:"limit"`
+}
+
+type exposureUtilization struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Exposure uint64 `json:"exposure"`
+	Limit    uint64 `json:"limit"`
+}
+
+type limitUtilization struct {
+	InvestorId string                `json:"investorId"`
+	Bonds      []bondUtilization     `json:"bonds"`
+	Exposures  []exposureUtilization `json:"exposures"`
+}
+
+func (t *BondChaincode) setConcentrationLimit(stub shim.ChaincodeStubInterface, percent uint64) (error) {
+	if percent == 0 || percent > 100 {
+		return errors.New("Incorrect percent. Expecting 1 to 100.")
+	}
+	log.Debugf("setConcentrationLimit: %d", percent)
+	return stub.PutState("concentrationlimit", []byte(strconv.FormatUint(percent, 10)))
+}
+
+func (t *BondChaincode) setExposureLimit(stub shim.ChaincodeStubInterface, kind string, name string, limit uint64) (error) {
+	if kind != "peril" && kind != "region" {
+		return errors.New("Incorrect kind. Expecting peril or region.")
+	}
+	if name == "" {
+		return errors.New("Incorrect name. Expecting " + kind + " name.")
+	}
+	log.Debugf("setExposureLimit: %s %s %d", kind, name, limit)
+	return stub.PutState("exposurelimit." + kind + "." + name, []byte(strconv.FormatUint(limit, 10)))
+}
+
+// getLimit returns 0 if the limit stored under the key is not set.
+func (t *BondChaincode) getLimit(stub shim.ChaincodeStubInterface, key string) (uint64, error) {
+	limitBytes, err := stub.GetState(key)
+	if err != nil {
+		log.Error("Failed retrieving " + key + ". Error: " + err.Error())
+		return 0, err
+	}
+	if len(limitBytes) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(limitBytes), 10, 64)
+}
+
+// getInvestorHoldings counts contracts per bond the investor holds or is buying and returns their bonds.
+func (t *BondChaincode) getInvestorHoldings(stub shim.ChaincodeStubInterface, investorId string) (map[string]uint64, map[string]bond, error) {
+	contracts, err := t.getOwnerContracts(stub, investorId)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err := t.getPendingTrades(stub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	holdings := make(map[string]uint64)
+	bonds := make(map[string]bond)
+	hold := func(issuerId string, bondId string) (error) {
+		if _, ok := bonds[bondId]; !ok {
+			bond_, err := t.getBond(stub, issuerId, bondId)
+			if err != nil {
+				return err
+			}
+			bonds[bondId] = bond_
+		}
+		holdings[bondId]++
+		return nil
+	}
+
+	for _, contract_ := range contracts {
+		// issuers hold contracts not placed yet
+		if contract_.OwnerId == contract_.IssuerId {
+			continue
+		}
+		if err := hold(contract_.IssuerId, contract_.BondId); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, trade_ := range pending {
+		if trade_.BuyerId != investorId {
+			continue
+		}
+		contract_, err := t.getContractById(stub, trade_.ContractId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := hold(contract_.IssuerId, contract_.BondId); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return holdings, bonds, nil
+}
+
+// getBondExposures returns the peril and region the bond is exposed to.
+func getBondExposures(bond_ bond) (exposures []exposureUtilization) {
+	if bond_.Trigger != "" {
+		exposures = append(exposures, exposureUtilization{Kind: "peril", Name: bond_.Trigger})
+	}
+	if bond_.Region != "" {
+		exposures = append(exposures, exposureUtilization{Kind: "region", Name: bond_.Region})
+	}
+	return exposures
+}
+
+// getExposure sums the principal of contracts held of bonds exposed to the peril or region.
+func getExposure(holdings map[string]uint64, bonds map[string]bond, kind string, name string) (uint64) {
+	var exposure uint64
+	for bondId, contracts := range holdings {
+		bond_ := bonds[bondId]
+		if (kind == "peril" && bond_.Trigger == name) || (kind == "region" && bond_.Region == name) {
+			exposure += contracts * PRICE_PER_CONTRACT
+		}
+	}
+	return exposure
+}
+
+// checkConcentration rejects a buy of the contract taking the investor over any of its limits.
+func (t *BondChaincode) checkConcentration(stub shim.ChaincodeStubInterface, contract_ contract, investorId string) (error) {
+	bond_, err := t.getBond(stub, contract_.IssuerId, contract_.BondId)
+	if err != nil {
+		return err
+	}
+	holdings, bonds, err := t.getInvestorHoldings(stub, investorId)
+	if err != nil {
+		return err
+	}
+
+	percent, err := t.getLimit(stub, "concentrationlimit")
+	if err != nil {
+		return err
+	}
+	total := bond_.Principal / PRICE_PER_CONTRACT
+	if percent > 0 && total > 0 && (holdings[bond_.Id] + 1) * 100 > percent * total {
+		return rejectTrade("CONCENTRATION_LIMIT", "Investor " + investorId + " holds " + strconv.FormatUint(holdings[bond_.Id], 10) + " of " + strconv.FormatUint(total, 10) + " contracts of bond " + bond_.Id + ", its limit is " + strconv.FormatUint(percent, 10) + "%")
+	}
+
+	for _, exposure_ := range getBondExposures(bond_) {
+		limit, err := t.getLimit(stub, "exposurelimit." + exposure_.Kind + "." + exposure_.Name)
+		if err != nil {
+			return err
+		}
+		exposure := getExposure(holdings, bonds, exposure_.Kind, exposure_.Name)
+		if limit > 0 && exposure + PRICE_PER_CONTRACT > limit {
+			return rejectTrade(strings.ToUpper(exposure_.Kind) + "_EXPOSURE_LIMIT", "Investor " + investorId + " is exposed to " + exposure_.Kind + " " + exposure_.Name + " by " + strconv.FormatUint(exposure, 10) + ", its limit is " + strconv.FormatUint(limit, 10))
+		}
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) getLimitUtilization(stub shim.ChaincodeStubInterface, investorId string) (limitUtilization, error) {
+	utilization := limitUtilization{InvestorId: investorId}
+
+	holdings, bonds, err := t.getInvestorHoldings(stub, investorId)
+	if err != nil {
+		return utilization, err
+	}
+	percent, err := t.getLimit(stub, "concentrationlimit")
+	if err != nil {
+		return utilization, err
+	}
+
+	var bondIds []string
+	for bondId := range holdings {
+		bondIds = append(bondIds, bondId)
+	}
+	sort.Strings(bondIds)
+
+	exposed := make(map[string]bool)
+	for _, bondId := range bondIds {
+		bond_ := bonds[bondId]
+		var held uint64
+		if total := bond_.Principal / PRICE_PER_CONTRACT; total > 0 {
+			held = holdings[bondId] * 100 / total
+		}
+		utilization.Bonds = append(utilization.Bonds, bondUtilization{BondId: bondId, Contracts: holdings[bondId], Percent: held, Limit: percent})
+
+		for _, exposure_ := range getBondExposures(bond_) {
+			key := "exposurelimit." + exposure_.Kind + "." + exposure_.Name
+			if exposed[key] {
+				continue
+			}
+			exposed[key] = true
+			if exposure_.Limit, err = t.getLimit(stub, key); err != nil {
+				return utilization, err
+			}
+			exposure_.Exposure = getExposure(holdings, bonds, exposure_.Kind, exposure_.Name)
+			utilization.Exposures = append(utilization.Exposures, exposure_)
+		}
+	}
+
+	return utilization, nil
+}
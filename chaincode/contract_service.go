@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
 	"errors"
 	"strconv"
 	"strings"
@@ -15,6 +16,12 @@ type contract struct {
 	CouponsPaid    uint64 `json:"couponsPaid"`
 	State          string `json:"state"`
 	BondId	       string `json:"bondid"`
+	CouponsMissed  uint64 `json:"couponsMissed"`
+	CouponState    string `json:"couponState"`
+	Arrears        uint64 `json:"arrears"`
+	DueSince       uint64 `json:"dueSince"`
+	Currency       string `json:"currency"`
+	OwnerCompany   string `json:"ownerCompany"`
 }
 
 func (contract_ *contract) readFromRow(row shim.Row) {
@@ -24,7 +31,30 @@ func (contract_ *contract) readFromRow(row shim.Row) {
 	contract_.CouponsPaid 	= row.Columns[3].GetUint64()
 	contract_.State 	= row.Columns[4].GetString_()
 	contract_.BondId	= row.Columns[5].GetString_()
+	contract_.CouponsMissed	= row.Columns[6].GetUint64()
+	contract_.CouponState	= row.Columns[7].GetString_()
+	contract_.Arrears	= row.Columns[8].GetUint64()
+	contract_.DueSince	= row.Columns[9].GetUint64()
+	contract_.Currency	= row.Columns[10].GetString_()
+	contract_.OwnerCompany	= row.Columns[11].GetString_()
+}
 
+func (contract_ *contract) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.IssuerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.OwnerId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.CouponsPaid}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.State}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.BondId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.CouponsMissed}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.CouponState}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.Arrears}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.DueSince}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.Currency}},
+			&shim.Column{Value: &shim.Column_String_{String_: contract_.OwnerCompany}}},
+	}
 }
 
 func (t *BondChaincode) initContracts(stub shim.ChaincodeStubInterface) (error) {
@@ -36,6 +66,12 @@ func (t *BondChaincode) initContracts(stub shim.ChaincodeStubInterface) (error)
 		&shim.ColumnDefinition{Name: "CouponsPaid", Type: shim.ColumnDefinition_UINT64, Key: false},
 		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
 		&shim.ColumnDefinition{Name: "BondId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "CouponsMissed", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "CouponState", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Arrears", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "DueSince", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCompany", Type: shim.ColumnDefinition_STRING, Key: false},
 	})
 	if err != nil {
 		log.Criticalf("Cannot initialize Contracts")
@@ -45,21 +81,21 @@ func (t *BondChaincode) initContracts(stub shim.ChaincodeStubInterface) (error)
 	return nil
 }
 
-func (t *BondChaincode) createContractsForBond(stub shim.ChaincodeStubInterface, bond_ bond, numberOfContracts uint64) ([]byte, error) {
+func (t *BondChaincode) createContractsForBond(stub shim.ChaincodeStubInterface, bond_ bond, numberOfContracts uint64, issuerCompany string) ([]byte, error) {
 
 	log.Debugf("function: %s, args: %s", "createContractsForBond", bond_.Id)
 	if numberOfContracts > 128 {
 		return nil, errors.New("Wrong number of contracts to create for bond.")
 	}
 
-	contract_ := contract{IssuerId: bond_.IssuerId, OwnerId: bond_.IssuerId, State: "offer", BondId:bond_.Id}
+	contract_ := contract{IssuerId: bond_.IssuerId, OwnerId: bond_.IssuerId, State: "offer", BondId:bond_.Id, CouponState: "current", Currency: bond_.Currency, OwnerCompany: issuerCompany}
 	for numberOfContracts > 0 {
 		numberOfContracts--
 		contract_.Id = bond_.Id + "." + strconv.FormatUint(numberOfContracts, 10)
 		if _, err := t.createContract(stub, contract_); err != nil {
 			return nil, err
 		}
-		if _, err := t.createTradeForContract(stub, contract_, 100); err != nil {
+		if _, err := t.createTradeForContract(stub, contract_, 100, issuerCompany); err != nil {
 			return nil, err
 		}
 	}
@@ -71,15 +107,7 @@ func (t *BondChaincode) createContract(stub shim.ChaincodeStubInterface, contrac
 
 	log.Debugf("function: %s, args: %s", "createContract", contract_.Id)
 
-	if ok, err := stub.InsertRow("Contracts", shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.IssuerId}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.Id}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.OwnerId}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.CouponsPaid}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.State}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.BondId}}},
-	}); !ok {
+	if ok, err := stub.InsertRow("Contracts", contract_.toRow()); !ok {
 		log.Error("Failed inserting new contract: " + err.Error())
 		return nil, err
 	}
@@ -100,6 +128,9 @@ func (t *BondChaincode) getContract(stub shim.ChaincodeStubInterface, issuerId s
 		log.Error(message)
 		return contract{}, errors.New(message)
 	}
+	if len(row.Columns) == 0 {
+		return contract{}, errors.New("No contract found for id " + contractId)
+	}
 
 	var result contract
 	result.readFromRow(row)
@@ -109,13 +140,16 @@ func (t *BondChaincode) getContract(stub shim.ChaincodeStubInterface, issuerId s
 
 func (t *BondChaincode) archiveContract(stub shim.ChaincodeStubInterface, contract_ contract) (error) {
 
-	trade_, err := t.getTradeForContract(stub, contract_.Id, "")
+	// Trade history is append-only and outlives the contract
+	trades, err := t.getTradesForContract(stub, contract_.Id)
 	if err != nil {
-		return fmt.Errorf("archiveContract operation failed. cannot get trade %s", err)
+		return fmt.Errorf("archiveContract operation failed. cannot get trades %s", err)
 	}
-	err = t.archiveTrade(stub, trade_.Id)
-	if err != nil {
-		return err
+	for _, trade_ := range trades {
+		err = t.archiveTrade(stub, trade_.Id)
+		if err != nil {
+			return err
+		}
 	}
 
 	var columns []shim.Column
@@ -143,15 +177,7 @@ func (t *BondChaincode) getContractById(stub shim.ChaincodeStubInterface, contra
 func (t *BondChaincode) updateContract(stub shim.ChaincodeStubInterface, contract_ contract) (bool, error) {
 	log.Debugf("updateContract: %+v", contract_)
 
-	return stub.ReplaceRow("Contracts", shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.IssuerId}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.Id}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.OwnerId}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: contract_.CouponsPaid}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.State}},
-			&shim.Column{Value: &shim.Column_String_{String_: contract_.BondId}}},
-	})
+	return stub.ReplaceRow("Contracts", contract_.toRow())
 }
 
 
@@ -185,9 +211,20 @@ func (t *BondChaincode) updateContract(stub shim.ChaincodeStubInterface, contrac
 //}
 
 
-func (t *BondChaincode) payContractCoupon(stub shim.ChaincodeStubInterface, contractId string) (bool, error) {
-	log.Debugf("payContractCoupon for: %s", contractId)
+func (t *BondChaincode) payContractCoupon(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) (bool, error) {
+	log.Debugf("payContractCoupon for: %s, amount: %d", instructionId, amount)
+
+	instruction, err := t.confirmPayment(stub, instructionId, "payContractCoupon", amount)
+	if err != nil {
+		log.Error("payContractCoupon failed on confirming payment: " + err.Error())
+		return false, err
+	}
+
+	return t.creditContractCoupon(stub, instruction.Reference, instruction.Amount)
+}
 
+// creditContractCoupon counts a coupon paid on the contract and clears its arrears by the amount.
+func (t *BondChaincode) creditContractCoupon(stub shim.ChaincodeStubInterface, contractId string, amount uint64) (bool, error) {
 	contract_, err := t.getContractById(stub, contractId)
 
 	if err != nil {
@@ -195,8 +232,104 @@ func (t *BondChaincode) payContractCoupon(stub shim.ChaincodeStubInterface, cont
 		return false, err
 	}
 
+	// payCoupons decided the contract was owed the coupon, it is credited even
+	// if the contract was reserved while the payment was under way
 	contract_.CouponsPaid++
-	return t.updateContract(stub, contract_)
+	if contract_.Arrears > amount {
+		contract_.Arrears -= amount
+	} else {
+		contract_.Arrears = 0
+		contract_.DueSince = 0
+		contract_.CouponState = "current"
+	}
+	if ok, err := t.updateContract(stub, contract_); !ok {
+		return ok, err
+	}
+
+	return true, t.refreshBondPayments(stub, contract_.IssuerId, contract_.BondId)
+}
+
+// deferCoupon keeps the coupon of a contract reserved in a pending trade until
+// the trade settles or is released. It is owed to the owner at the coupon date.
+func (t *BondChaincode) deferCoupon(stub shim.ChaincodeStubInterface, coupon couponAllocation) (error) {
+	log.Debugf("deferCoupon: %+v", coupon)
+
+	coupons, err := t.getDeferredCoupons(stub, coupon.ContractId)
+	if err != nil {
+		return err
+	}
+	coupons = append(coupons, coupon)
+
+	couponsBytes, err := json.Marshal(coupons)
+	if err != nil {
+		return err
+	}
+	return stub.PutState("deferredcoupons." + coupon.ContractId, couponsBytes)
+}
+
+func (t *BondChaincode) getDeferredCoupons(stub shim.ChaincodeStubInterface, contractId string) (coupons []couponAllocation, err error) {
+	couponsBytes, err := stub.GetState("deferredcoupons." + contractId)
+	if err != nil {
+		log.Error("Failed retrieving deferred coupons. Error: " + err.Error())
+		return nil, err
+	}
+	if len(couponsBytes) == 0 {
+		return nil, nil
+	}
+
+	err = json.Unmarshal(couponsBytes, &coupons)
+	return coupons, err
+}
+
+// payDeferredCoupons submits the coupons deferred while the contract was reserved.
+func (t *BondChaincode) payDeferredCoupons(stub shim.ChaincodeStubInterface, contractId string) (error) {
+	coupons, err := t.getDeferredCoupons(stub, contractId)
+	if err != nil || len(coupons) == 0 {
+		return err
+	}
+	if err := stub.DelState("deferredcoupons." + contractId); err != nil {
+		return err
+	}
+
+	for _, coupon := range coupons {
+		_, err = t.submitPayment(stub, coupon.BondId, coupon.Currency, paymentInstruction{
+			Payer: 		coupon.Payer,
+			Payee: 		coupon.Payee,
+			Amount: 	coupon.Amount,
+			Purpose: 	"coupon",
+			Reference: 	coupon.ContractId,
+			Callback: 	"payContractCoupon"})
+		if err != nil {
+			log.Error("cannot submit deferred coupon payment for contract " + contractId + ": " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// missContractCoupon records a coupon the issuer failed to pay, adding arrears
+// not accrued yet, and keeps the contract in grace period unless in default.
+func (t *BondChaincode) missContractCoupon(stub shim.ChaincodeStubInterface, contract_ contract, arrears uint64) (error) {
+	log.Debugf("missContractCoupon for: %s", contract_.Id)
+
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	contract_.CouponsMissed++
+	contract_.Arrears += arrears
+	if contract_.DueSince == 0 {
+		contract_.DueSince = now
+	}
+	if contract_.CouponState != "default" {
+		contract_.CouponState = "grace"
+	}
+	if _, err := t.updateContract(stub, contract_); err != nil {
+		return err
+	}
+
+	return t.refreshBondPayments(stub, contract_.IssuerId, contract_.BondId)
 }
 
 func (t *BondChaincode) getIssuerContracts(stub shim.ChaincodeStubInterface, issuerId string) (contracts []contract, err error) {
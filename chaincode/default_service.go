@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"strconv"
+)
+
+// Coupons owed to a contract accrue as arrears when they are instructed and
+// are cleared when the payment is confirmed. A contract with arrears is in
+// grace period until the grace period elapses and it goes into default. A
+// bond with a contract in default is in default itself.
+
+// seconds arrears may stay unpaid before a contract goes into default
+const GRACE_PERIOD uint64 = 30 * 86400
+
+type issuerDefault struct {
+	IssuerId   string   `json:"issuerId"`
+	BondIds    []string `json:"bondIds"`
+	Contracts  uint64   `json:"contracts"`
+	AmountOwed uint64   `json:"amountOwed"`
+}
+
+func (t *BondChaincode) getGracePeriod(stub shim.ChaincodeStubInterface) (uint64, error) {
+	periodBytes, err := stub.GetState("graceperiod")
+	if err != nil {
+		log.Error("Failed retrieving grace period. Error: " + err.Error())
+		return 0, err
+	}
+	if len(periodBytes) == 0 {
+		return GRACE_PERIOD, nil
+	}
+	return strconv.ParseUint(string(periodBytes), 10, 64)
+}
+
+func (t *BondChaincode) accrueArrears(stub shim.ChaincodeStubInterface, contractId string, amount uint64) (error) {
+	contract_, err := t.getContractById(stub, contractId)
+	if err != nil {
+		return err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	contract_.Arrears += amount
+	if contract_.DueSince == 0 {
+		contract_.DueSince = now
+	}
+	if contract_.CouponState != "default" {
+		contract_.CouponState = "grace"
+	}
+	log.Debugf("accrueArrears: %+v", contract_)
+
+	_, err = t.updateContract(stub, contract_)
+	return err
+}
+
+// refreshBondPayments marks the bond's due coupons paid once none of its
+// contracts is in arrears and moves the bond in and out of default.
+func (t *BondChaincode) refreshBondPayments(stub shim.ChaincodeStubInterface, issuerId string, bondId string) (error) {
+	bond_, err := t.getBond(stub, issuerId, bondId)
+	if err != nil {
+		return err
+	}
+	contracts, err := t.getIssuerContracts(stub, issuerId)
+	if err != nil {
+		return err
+	}
+
+	inArrears := false
+	inDefault := false
+	for _, contract_ := range contracts {
+		if contract_.BondId != bondId {
+			continue
+		}
+		if contract_.Arrears > 0 {
+			inArrears = true
+		}
+		if contract_.CouponState == "default" {
+			inDefault = true
+		}
+	}
+
+	if !inArrears {
+		bond_.CouponsPaid = bond_.CouponsDue
+	}
+	if inDefault && bond_.State == "active" {
+		bond_.State = "default"
+	} else if !inDefault && bond_.State == "default" {
+		bond_.State = "active"
+	}
+
+	if ok, err := stub.ReplaceRow("Bonds", bond_.toRow()); !ok {
+		log.Error("Failed updating bond payments: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+func (t *BondChaincode) checkCouponDefaults(stub shim.ChaincodeStubInterface) (error) {
+	log.Debugf("checkCouponDefaults called ")
+
+	contracts, err := t.getAllContracts(stub)
+	if err != nil {
+		log.Error("checkCouponDefaults failed on retrieving contracts: " + err.Error())
+		return err
+	}
+	gracePeriod, err := t.getGracePeriod(stub)
+	if err != nil {
+		return err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	count := 0
+
+	for _, contract_ := range contracts {
+		if contract_.Arrears == 0 || contract_.CouponState == "default" || contract_.DueSince + gracePeriod > now {
+			continue
+		}
+		contract_.CouponState = "default"
+		if _, err := t.updateContract(stub, contract_); err != nil {
+			return err
+		}
+		if err := t.refreshBondPayments(stub, contract_.IssuerId, contract_.BondId); err != nil {
+			return err
+		}
+		count++
+	}
+	log.Debugf("Contracts Defaulted: %d out of %d",
+		count, len(contracts))
+
+	return nil
+}
+
+func (t *BondChaincode) getDefaults(stub shim.ChaincodeStubInterface) ([]issuerDefault, error) {
+	contracts, err := t.getAllContracts(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaults []issuerDefault
+	byIssuer := make(map[string]int)
+	for _, contract_ := range contracts {
+		if contract_.CouponState != "default" {
+			continue
+		}
+		index, ok := byIssuer[contract_.IssuerId]
+		if !ok {
+			index = len(defaults)
+			byIssuer[contract_.IssuerId] = index
+			defaults = append(defaults, issuerDefault{IssuerId: contract_.IssuerId})
+		}
+
+		default_ := &defaults[index]
+		listed := false
+		for _, bondId := range default_.BondIds {
+			if bondId == contract_.BondId {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			default_.BondIds = append(default_.BondIds, contract_.BondId)
+		}
+		default_.Contracts++
+		default_.AmountOwed += contract_.Arrears
+	}
+
+	return defaults, nil
+}
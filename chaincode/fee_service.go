@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Fees are charged in basis points of the clean amount of a trade. On a
+// primary placement, a trade whose seller is the issuer, the issuer pays the
+// placement fee. On a secondary trade the buyer pays the trading fee on top of
+// the price. Each fee goes out as its own payment instruction to the
+// beneficiary set in the fee schedule.
+
+const BPS_DIVISOR uint64 = 10000
+
+type feeSchedule struct {
+	TradeBps             uint64 `json:"tradeBps"`
+	TradeBeneficiary     string `json:"tradeBeneficiary"`
+	PlacementBps         uint64 `json:"placementBps"`
+	PlacementBeneficiary string `json:"placementBeneficiary"`
+}
+
+func (t *BondChaincode) setFeeSchedule(stub shim.ChaincodeStubInterface, schedule feeSchedule) (error) {
+	if schedule.TradeBps > BPS_DIVISOR || schedule.PlacementBps > BPS_DIVISOR {
+		return errors.New("Incorrect fee. Expecting at most " + strconv.FormatUint(BPS_DIVISOR, 10) + " basis points.")
+	}
+	if (schedule.TradeBps > 0 && schedule.TradeBeneficiary == "") || (schedule.PlacementBps > 0 && schedule.PlacementBeneficiary == "") {
+		return errors.New("Incorrect fee schedule. Expecting a beneficiary for every fee charged.")
+	}
+
+	scheduleBytes, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	log.Debugf("setFeeSchedule: %+v", schedule)
+	return stub.PutState("feeschedule", scheduleBytes)
+}
+
+// getFeeSchedule returns an empty schedule, charging no fees, until one is set.
+func (t *BondChaincode) getFeeSchedule(stub shim.ChaincodeStubInterface) (feeSchedule, error) {
+	var schedule feeSchedule
+
+	scheduleBytes, err := stub.GetState("feeschedule")
+	if err != nil {
+		log.Error("Failed retrieving fee schedule. Error: " + err.Error())
+		return schedule, err
+	}
+	if len(scheduleBytes) == 0 {
+		return schedule, nil
+	}
+
+	err = json.Unmarshal(scheduleBytes, &schedule)
+	return schedule, err
+}
+
+// getTradeFee works out the fee due on a trade settling for amount and the
+// member paying it.
+func (t *BondChaincode) getTradeFee(stub shim.ChaincodeStubInterface, trade_ trade, contract_ contract, amount uint64) (fee paymentInstruction, err error) {
+	schedule, err := t.getFeeSchedule(stub)
+	if err != nil {
+		return fee, err
+	}
+
+	fee.Purpose = "fee"
+	fee.Reference = trade_.ContractId
+	fee.TradeId = trade_.Id
+	fee.Callback = "payFee"
+	if trade_.SellerId == contract_.IssuerId {
+		fee.Payer = trade_.SellerId
+		fee.Payee = schedule.PlacementBeneficiary
+		fee.Amount = amount * schedule.PlacementBps / BPS_DIVISOR
+	} else {
+		fee.Payer = trade_.BuyerId
+		fee.Payee = schedule.TradeBeneficiary
+		fee.Amount = amount * schedule.TradeBps / BPS_DIVISOR
+	}
+	return fee, nil
+}
+
+// payFee is called back by the rail once a fee was paid to its beneficiary.
+func (t *BondChaincode) payFee(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %d", "payFee", instructionId, amount)
+
+	// the fee of a trade that did not settle is paid back
+	if instruction, err := t.getPayment(stub, instructionId); err == nil && instruction.Callback == "payFee" && instruction.Status == "cancelled" {
+		return nil, t.refundPayment(stub, instruction, amount, "trade " + strconv.FormatUint(instruction.TradeId, 10) + " did not settle")
+	}
+
+	if _, err := t.confirmPayment(stub, instructionId, "payFee", amount); err != nil {
+		message := "Failed confirming fee payment. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	return nil, nil
+}
+
+func (t *BondChaincode) getFees(stub shim.ChaincodeStubInterface, memberId string) (fees []paymentInstruction, err error) {
+	payments, err := t.getPayments(stub, memberId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instruction := range payments {
+		if instruction.Purpose == "fee" {
+			fees = append(fees, instruction)
+		}
+	}
+	return fees, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"strconv"
+)
+
+// Only investors cleared by compliance may buy contracts. Compliance keeps a
+// whitelist of investors with their category and the date their clearance
+// expires. Buyers not on the whitelist, or whose clearance expired, are
+// rejected with a reason code. Holdings of investors no longer eligible stay
+// with them and are reported to auditors.
+
+var investorCategories = []string{"qualified", "accredited", "institutional"}
+
+type clearance struct {
+	InvestorId string `json:"investorId"`
+	Category   string `json:"category"`
+	Expiry     uint64 `json:"expiry"`
+	ClearedBy  string `json:"clearedBy"`
+	Timestamp  uint64 `json:"timestamp"`
+}
+
+type ineligibleHolding struct {
+	ContractId string `json:"contractId"`
+	OwnerId    string `json:"ownerId"`
+	Reason     string `json:"reason"`
+}
+
+func (clearance_ *clearance) readFromRow(row shim.Row) {
+	clearance_.InvestorId 	= row.Columns[0].GetString_()
+	clearance_.Category 	= row.Columns[1].GetString_()
+	clearance_.Expiry 	= row.Columns[2].GetUint64()
+	clearance_.ClearedBy 	= row.Columns[3].GetString_()
+	clearance_.Timestamp 	= row.Columns[4].GetUint64()
+}
+
+func (clearance_ *clearance) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: clearance_.InvestorId}},
+			&shim.Column{Value: &shim.Column_String_{String_: clearance_.Category}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: clearance_.Expiry}},
+			&shim.Column{Value: &shim.Column_String_{String_: clearance_.ClearedBy}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: clearance_.Timestamp}}},
+	}
+}
+
+func (t *BondChaincode) initWhitelist(stub shim.ChaincodeStubInterface) (error) {
+	// Create whitelist table
+	err := stub.CreateTable("Whitelist", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "InvestorId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Category", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Expiry", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "ClearedBy", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Whitelist")
+		return errors.New("Failed creating Whitelist table.")
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) whitelistInvestor(stub shim.ChaincodeStubInterface, investorId string, category string, expiry uint64, callerName string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s, %d", "whitelistInvestor", investorId, category, expiry)
+
+	known := false
+	for _, investorCategory := range investorCategories {
+		if category == investorCategory {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, errors.New("Incorrect category. Expecting qualified, accredited or institutional.")
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if expiry <= now {
+		return nil, errors.New("Incorrect expiry. Expecting a future date.")
+	}
+
+	clearance_ := clearance{InvestorId: investorId, Category: category, Expiry: expiry, ClearedBy: callerName, Timestamp: now}
+	ok, err := stub.InsertRow("Whitelist", clearance_.toRow())
+	if err != nil {
+		log.Error("Failed inserting clearance: " + err.Error())
+		return nil, err
+	}
+	if !ok {
+		if _, err := stub.ReplaceRow("Whitelist", clearance_.toRow()); err != nil {
+			log.Error("Failed replacing clearance: " + err.Error())
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (t *BondChaincode) delistInvestor(stub shim.ChaincodeStubInterface, investorId string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "delistInvestor", investorId)
+
+	var columns []shim.Column
+	columnInvestorId := shim.Column{Value: &shim.Column_String_{String_: investorId}}
+	columns = append(columns, columnInvestorId)
+
+	return nil, stub.DeleteRow("Whitelist", columns)
+}
+
+// getClearance returns false if the investor is not on the whitelist.
+func (t *BondChaincode) getClearance(stub shim.ChaincodeStubInterface, investorId string) (clearance, bool, error) {
+	var columns []shim.Column
+	columnInvestorId := shim.Column{Value: &shim.Column_String_{String_: investorId}}
+	columns = append(columns, columnInvestorId)
+
+	row, err := stub.GetRow("Whitelist", columns)
+	if err != nil {
+		message := "Failed retrieving clearance. Error: " + err.Error()
+		log.Error(message)
+		return clearance{}, false, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return clearance{}, false, nil
+	}
+
+	var result clearance
+	result.readFromRow(row)
+	return result, true, nil
+}
+
+func (t *BondChaincode) getWhitelist(stub shim.ChaincodeStubInterface) (clearances []clearance, err error) {
+	rows, err := stub.GetRows("Whitelist", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving whitelist. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result clearance
+		result.readFromRow(row)
+		clearances = append(clearances, result)
+	}
+
+	return clearances, nil
+}
+
+// checkEligibility rejects investors not cleared by compliance at the time given.
+func (t *BondChaincode) checkEligibility(stub shim.ChaincodeStubInterface, investorId string, now uint64) (error) {
+	clearance_, ok, err := t.getClearance(stub, investorId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return rejectTrade("KYC_NOT_CLEARED", "Investor " + investorId + " is not cleared by compliance")
+	}
+	if clearance_.Expiry <= now {
+		return rejectTrade("KYC_EXPIRED", "Clearance of investor " + investorId + " expired at " + strconv.FormatUint(clearance_.Expiry, 10))
+	}
+	return nil
+}
+
+// getIneligibleHoldings lists contracts held by investors not eligible at the time given.
+func (t *BondChaincode) getIneligibleHoldings(stub shim.ChaincodeStubInterface, now uint64) (holdings []ineligibleHolding, err error) {
+	contracts, err := t.getAllContracts(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, contract_ := range contracts {
+		// contracts not placed yet are held by their issuer
+		if contract_.OwnerId == contract_.IssuerId {
+			continue
+		}
+		err := t.checkEligibility(stub, contract_.OwnerId, now)
+		if rejection, ok := err.(*tradeRejection); ok {
+			holdings = append(holdings, ineligibleHolding{ContractId: contract_.Id, OwnerId: contract_.OwnerId, Reason: rejection.Code})
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return holdings, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+)
+
+// Members keeps the certificate attributes of members seen issuing or buying
+// so that they are at hand when the member is not the caller, e.g. an
+// investor's jurisdiction in a coupon run started by the system.
+
+type member struct {
+	Id           string `json:"id"`
+	Role         string `json:"role"`
+	Company      string `json:"company"`
+	Jurisdiction string `json:"jurisdiction"`
+}
+
+func (member_ *member) readFromRow(row shim.Row) {
+	member_.Id 		= row.Columns[0].GetString_()
+	member_.Role 		= row.Columns[1].GetString_()
+	member_.Company 	= row.Columns[2].GetString_()
+	member_.Jurisdiction 	= row.Columns[3].GetString_()
+}
+
+func (member_ *member) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: member_.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: member_.Role}},
+			&shim.Column{Value: &shim.Column_String_{String_: member_.Company}},
+			&shim.Column{Value: &shim.Column_String_{String_: member_.Jurisdiction}}},
+	}
+}
+
+func (t *BondChaincode) initMembers(stub shim.ChaincodeStubInterface) (error) {
+	// Create members table
+	err := stub.CreateTable("Members", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Company", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Jurisdiction", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Members")
+		return errors.New("Failed creating Members table.")
+	}
+
+	return nil
+}
+
+// saveMember records the member's current attributes, replacing those seen before.
+func (t *BondChaincode) saveMember(stub shim.ChaincodeStubInterface, member_ member) (error) {
+	if member_.Id == "" {
+		return errors.New("Member without name cannot be saved")
+	}
+
+	ok, err := stub.InsertRow("Members", member_.toRow())
+	if err != nil {
+		log.Error("Failed inserting member: " + err.Error())
+		return err
+	}
+	if !ok {
+		if _, err := stub.ReplaceRow("Members", member_.toRow()); err != nil {
+			log.Error("Failed replacing member: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// getMember returns a member with only its id set if the member was never seen.
+func (t *BondChaincode) getMember(stub shim.ChaincodeStubInterface, memberId string) (member, error) {
+	var columns []shim.Column
+	columnID := shim.Column{Value: &shim.Column_String_{String_: memberId}}
+	columns = append(columns, columnID)
+
+	row, err := stub.GetRow("Members", columns)
+	if err != nil {
+		message := "Failed retrieving member. Error: " + err.Error()
+		log.Error(message)
+		return member{}, errors.New(message)
+	}
+
+	result := member{Id: memberId}
+	if len(row.Columns) != 0 {
+		result.readFromRow(row)
+	}
+	return result, nil
+}
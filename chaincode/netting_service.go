@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+)
+
+// In netting mode a coupon run sends one instruction per payer, payee and
+// currency instead of one per contract. The instruction carries allocations
+// to its contracts and its confirmation credits each of them.
+
+type couponAllocation struct {
+	ContractId string `json:"contractId"`
+	BondId     string `json:"bondId"`
+	Payer      string `json:"payer"`
+	Payee      string `json:"payee"`
+	Currency   string `json:"currency"`
+	Amount     uint64 `json:"amount"`
+}
+
+func (t *BondChaincode) isCouponNetting(stub shim.ChaincodeStubInterface) (bool, error) {
+	nettingBytes, err := stub.GetState("couponnetting")
+	if err != nil {
+		log.Error("Failed retrieving coupon netting mode. Error: " + err.Error())
+		return false, err
+	}
+	return string(nettingBytes) == "true", nil
+}
+
+// submitNettedCoupons aggregates coupons per payer, payee and currency and
+// submits an instruction per aggregate over the currency's rail.
+func (t *BondChaincode) submitNettedCoupons(stub shim.ChaincodeStubInterface, coupons []couponAllocation) (int, error) {
+	var netted []paymentInstruction
+	byParties := make(map[string]int)
+
+	for _, coupon := range coupons {
+		currency := coupon.Currency
+		key := coupon.Payer + "|" + coupon.Payee + "|" + currency
+
+		index, ok := byParties[key]
+		if !ok {
+			index = len(netted)
+			byParties[key] = index
+			netted = append(netted, paymentInstruction{
+				Payer: 		coupon.Payer,
+				Payee: 		coupon.Payee,
+				Currency: 	currency,
+				Purpose: 	"coupon",
+				Reference: 	"netted",
+				Callback: 	"payNettedCoupons"})
+		}
+		netted[index].Amount += coupon.Amount
+		netted[index].Allocations = append(netted[index].Allocations, coupon)
+	}
+
+	count := 0
+	for _, instruction := range netted {
+		if _, err := t.submitPayment(stub, "", instruction.Currency, instruction); err != nil {
+			log.Errorf("cannot submit netted coupon payment from %s to %s: %s", instruction.Payer, instruction.Payee, err.Error())
+			continue
+		}
+		count++
+	}
+	log.Debugf("submitNettedCoupons: %d instructions for %d coupons", count, len(coupons))
+
+	return count, nil
+}
+
+func (t *BondChaincode) payNettedCoupons(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %d", "payNettedCoupons", instructionId, amount)
+
+	instruction, err := t.confirmPayment(stub, instructionId, "payNettedCoupons", amount)
+	if err != nil {
+		log.Error("payNettedCoupons failed on confirming payment: " + err.Error())
+		return nil, err
+	}
+	if len(instruction.Allocations) == 0 {
+		return nil, errors.New("Payment instruction " + instructionId + " has no allocations")
+	}
+
+	for _, allocation := range instruction.Allocations {
+		if _, err := t.creditContractCoupon(stub, allocation.ContractId, allocation.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"fmt"
+)
+
+const SWIFT_RAIL = "swift"
+const TOKEN_RAIL = "token"
+const ORACLE_RAIL = "oracle"
+const CASH_RAIL = "cash"
+
+// PaymentRail moves money for a payment instruction and eventually reports
+// back through the instruction's callback.
+type PaymentRail interface {
+	Name() string
+	Submit(stub shim.ChaincodeStubInterface, instruction paymentInstruction) error
+}
+
+func (t *BondChaincode) newPaymentRail(railName string) (PaymentRail, error) {
+	if railName == SWIFT_RAIL {
+		return &swiftRail{t}, nil
+	} else if railName == TOKEN_RAIL {
+		return &tokenRail{t}, nil
+	} else if railName == ORACLE_RAIL {
+		return &oracleRail{t}, nil
+	} else if railName == CASH_RAIL {
+		return &cashRail{t}, nil
+	}
+	return nil, errors.New("Unknown payment rail " + railName + ". Expecting swift, token, oracle or cash.")
+}
+
+// swiftRail sends the instruction to the swift chaincode which calls back once
+// the bank transfer is done.
+type swiftRail struct {
+	t *BondChaincode
+}
+
+func (rail *swiftRail) Name() string {
+	return SWIFT_RAIL
+}
+
+func (rail *swiftRail) Submit(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	var args [][]byte
+
+	args = append(args, []byte("submitPayment"))
+	args = append(args, []byte(instruction.Payer))
+	args = append(args, []byte(instruction.Payee))
+	args = append(args, []byte(strconv.FormatUint(instruction.Amount, 10)))
+	args = append(args, []byte(instruction.Purpose))
+	args = append(args, []byte(instruction.Reference))
+	chainId, _ := rail.t.getCallBackChaincodeId(stub)
+	args = append(args, []byte(chainId))
+	args = append(args, []byte(instruction.Callback))
+	args = append(args, []byte(instruction.Payload))
+	args = append(args, []byte(instruction.Currency))
+
+	chainCodeToCall, err := rail.t.GetSwiftChaincodeToCall(stub)
+	if err != nil {
+		return err
+	}
+
+	response, err := stub.InvokeChaincode(chainCodeToCall, args)
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return errors.New(errStr)
+	}
+
+	log.Debugf("Invoke chaincode successful. Got response %s", string(response))
+
+	return nil
+}
+
+// tokenRail transfers on-ledger tokens held in a token chaincode. The transfer
+// happens in the same transaction so the callback runs right away.
+type tokenRail struct {
+	t *BondChaincode
+}
+
+func (rail *tokenRail) Name() string {
+	return TOKEN_RAIL
+}
+
+func (rail *tokenRail) Submit(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	var args [][]byte
+
+	args = append(args, []byte("transfer"))
+	args = append(args, []byte(instruction.Payer))
+	args = append(args, []byte(instruction.Payee))
+	args = append(args, []byte(strconv.FormatUint(instruction.Amount, 10)))
+	args = append(args, []byte(instruction.Reference))
+	args = append(args, []byte(instruction.Currency))
+
+	tokenChaincode, err := rail.t.getPaymentChaincode(stub, "tokenchaincode")
+	if err != nil {
+		return err
+	}
+
+	response, err := stub.InvokeChaincode(tokenChaincode.Id, args)
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to invoke token chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return errors.New(errStr)
+	}
+
+	log.Debugf("Invoke token chaincode successful. Got response %s", string(response))
+
+	return rail.t.paymentCallback(stub, instruction.Callback, instruction.Payload, instruction.Amount)
+}
+
+// oracleRail leaves the payment off-ledger: the instruction is published as a
+// chaincode event and a payment oracle calls back once it sees the transfer.
+type oracleRail struct {
+	t *BondChaincode
+}
+
+func (rail *oracleRail) Name() string {
+	return ORACLE_RAIL
+}
+
+// oracleBatch holds the instructions published by the oracle rail in the
+// transaction TxId.
+type oracleBatch struct {
+	TxId         string               `json:"txId"`
+	Instructions []paymentInstruction `json:"instructions"`
+}
+
+// Only one event is kept per transaction so every event carries all the
+// instructions submitted in the transaction so far. They are collected in
+// state under the transaction id, a batch of an earlier transaction is dropped.
+func (rail *oracleRail) Submit(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	var batch oracleBatch
+
+	batchBytes, err := stub.GetState("oraclebatch")
+	if err != nil {
+		return err
+	}
+	if len(batchBytes) != 0 {
+		if err := json.Unmarshal(batchBytes, &batch); err != nil {
+			return err
+		}
+	}
+	if batch.TxId != stub.GetTxID() {
+		batch = oracleBatch{TxId: stub.GetTxID()}
+	}
+	batch.Instructions = append(batch.Instructions, instruction)
+
+	batchBytes, err = json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState("oraclebatch", batchBytes); err != nil {
+		return err
+	}
+
+	instructionsBytes, err := json.Marshal(batch.Instructions)
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent("paymentInstructions", instructionsBytes)
+}
+
+// cashRail settles with the chaincode's own cash tokens: the payer is debited,
+// the payee credited and the callback run atomically with no external chaincode.
+type cashRail struct {
+	t *BondChaincode
+}
+
+func (rail *cashRail) Name() string {
+	return CASH_RAIL
+}
+
+func (rail *cashRail) Submit(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	if _, err := rail.t.transfer(stub, instruction.Payer, instruction.Payee, instruction.Currency, instruction.Amount); err != nil {
+		return err
+	}
+
+	return rail.t.paymentCallback(stub, instruction.Callback, instruction.Payload, instruction.Amount)
+}
@@ -2,64 +2,635 @@ package main
 
 import (
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
 	"errors"
 	"strconv"
-	"fmt"
 )
 
-func (t *BondChaincode) submitPaymentInstruction(stub shim.ChaincodeStubInterface, payer string, payee string, price uint64, paymentType string, instruction string, callback string, payload string) (error) {
-	log.Debugf("payment instructions")
-	var args [][]byte
+// paymentChaincode identifies the chaincode payment instructions are sent to.
+// Channel and version are kept for networks that address chaincodes by them.
+type paymentChaincode struct {
+	Id      string `json:"id"`
+	Channel string `json:"channel"`
+	Version string `json:"version"`
+}
+
+func (t *BondChaincode) setPaymentChaincode(stub shim.ChaincodeStubInterface, key string, args []string) (error) {
+	if len(args) < 1 || len(args) > 3 || args[0] == "" {
+		return errors.New("Incorrect arguments. Expecting chaincodeID and optional channel, version.")
+	}
+
+	var paymentChaincode_ paymentChaincode
+	paymentChaincode_.Id = args[0]
+	if len(args) > 1 {
+		paymentChaincode_.Channel = args[1]
+	}
+	if len(args) > 2 {
+		paymentChaincode_.Version = args[2]
+	}
+
+	paymentChaincodeBytes, err := json.Marshal(paymentChaincode_)
+	if err != nil {
+		return err
+	}
+	log.Debugf("setPaymentChaincode %s: %+v", key, paymentChaincode_)
+	return stub.PutState(key, paymentChaincodeBytes)
+}
+
+func (t *BondChaincode) getPaymentChaincode(stub shim.ChaincodeStubInterface, key string) (paymentChaincode, error) {
+	var paymentChaincode_ paymentChaincode
+
+	paymentChaincodeBytes, err := stub.GetState(key)
+	if err != nil {
+		return paymentChaincode_, err
+	}
+	if len(paymentChaincodeBytes) == 0 {
+		return paymentChaincode_, errors.New("Payment chaincode " + key + " is not configured.")
+	}
+
+	err = json.Unmarshal(paymentChaincodeBytes, &paymentChaincode_)
+	return paymentChaincode_, err
+}
+
+func (t *BondChaincode) GetSwiftChaincodeToCall(stub shim.ChaincodeStubInterface) (string, error) {
+	paymentChaincode_, err := t.getPaymentChaincode(stub, "paymentchaincode")
+	if err != nil {
+		return "", err
+	}
+	return paymentChaincode_.Id, nil
+}
+
+// paymentInstruction asks a payment rail to move Amount from Payer to Payee.
+// Once the money moved the rail calls Callback with Payload, the instruction id,
+// back on this chaincode. Every instruction is kept in the Payments table.
+type paymentInstruction struct {
+	Id        uint64 `json:"id"`
+	Payer     string `json:"payer"`
+	Payee     string `json:"payee"`
+	Amount    uint64 `json:"amount"`
+	Currency  string `json:"currency"`
+	Purpose   string `json:"purpose"`
+	Reference string `json:"reference"`
+	TradeId   uint64 `json:"tradeId"`
+	Callback  string `json:"callback"`
+	Payload   string `json:"payload"`
+	Status    string `json:"status"`
+	Timestamp uint64 `json:"timestamp"`
+	Reason    string `json:"reason"`
+	Rail      string `json:"rail"`
+	// coupons a netted instruction pays
+	Allocations []couponAllocation `json:"allocations,omitempty"`
+}
+
+func (instruction *paymentInstruction) readFromRow(row shim.Row) {
+	instruction.Id 		= row.Columns[0].GetUint64()
+	instruction.Payer 	= row.Columns[1].GetString_()
+	instruction.Payee 	= row.Columns[2].GetString_()
+	instruction.Amount 	= row.Columns[3].GetUint64()
+	instruction.Currency 	= row.Columns[4].GetString_()
+	instruction.Purpose 	= row.Columns[5].GetString_()
+	instruction.Reference 	= row.Columns[6].GetString_()
+	instruction.TradeId 	= row.Columns[7].GetUint64()
+	instruction.Callback 	= row.Columns[8].GetString_()
+	instruction.Payload 	= row.Columns[9].GetString_()
+	instruction.Status 	= row.Columns[10].GetString_()
+	instruction.Timestamp 	= row.Columns[11].GetUint64()
+	instruction.Reason 	= row.Columns[12].GetString_()
+	if allocations := row.Columns[13].GetString_(); allocations != "" {
+		json.Unmarshal([]byte(allocations), &instruction.Allocations)
+	}
+	instruction.Rail 	= row.Columns[14].GetString_()
+}
+
+func (instruction *paymentInstruction) toRow() (shim.Row) {
+	var allocations string
+	if len(instruction.Allocations) != 0 {
+		allocationsBytes, _ := json.Marshal(instruction.Allocations)
+		allocations = string(allocationsBytes)
+	}
 
-	args = append(args, []byte("submitPayment"))
-	args = append(args, []byte(payer))
-	args = append(args, []byte(payee))
-	args = append(args, []byte(strconv.FormatUint(price , 10)))
-	args = append(args, []byte(paymentType))
-	args = append(args, []byte(instruction))
-	chainId, _ := t.getCallBackChaincodeId(stub)
-	args = append(args, []byte(chainId))
-	args = append(args, []byte(callback))
-	args = append(args, []byte(payload))
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: instruction.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Payer}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Payee}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: instruction.Amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Currency}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Purpose}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Reference}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: instruction.TradeId}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Callback}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Payload}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Status}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: instruction.Timestamp}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Reason}},
+			&shim.Column{Value: &shim.Column_String_{String_: allocations}},
+			&shim.Column{Value: &shim.Column_String_{String_: instruction.Rail}}},
+	}
+}
 
-	response, err := stub.InvokeChaincode(t.GetSwiftChaincodeToCall(), args)
+func (t *BondChaincode) initPayments(stub shim.ChaincodeStubInterface) (error) {
+	// Create payments table
+	err := stub.CreateTable("Payments", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: "Payer", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Payee", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Purpose", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Reference", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "TradeId", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Callback", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Payload", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Allocations", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Rail", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return errors.New(errStr)
+		log.Criticalf("Cannot initialize Payments")
+		return errors.New("Failed creating Payments table.")
 	}
 
-	log.Debugf("Invoke chaincode successful. Got response %s", string(response))
+	err = stub.PutState("PaymentsCounter", []byte(strconv.FormatUint(0, 10)))
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (t *BondChaincode) sendPaymentInstruction(stub shim.ChaincodeStubInterface, trade_ trade, newOwnerId string) (error) {
-	log.Debugf("payment instructions for payment:%+v", trade_)
+// submitPayment records the instruction and sends it over the rail configured
+// for the bond or its currency. A rail failure is recorded on the instruction
+// returned, callers check its status.
+// An instruction to or from a sanctioned member is held for compliance review.
+func (t *BondChaincode) submitPayment(stub shim.ChaincodeStubInterface, bondId string, currency string, instruction paymentInstruction) (paymentInstruction, error) {
+	if instruction.Currency == "" {
+		instruction.Currency = currency
+	}
+	if instruction.Currency == "" {
+		instruction.Currency = DEFAULT_CURRENCY
+	}
 
+	counter, err := t.incrementAndGetCounter(stub, "PaymentsCounter")
+	if err != nil {
+		return instruction, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return instruction, err
+	}
+	instruction.Id = counter
+	instruction.Payload = strconv.FormatUint(counter, 10)
+	instruction.Status = "submitted"
+	instruction.Timestamp = now
 
-	var args [][]byte
+	// callbacks are verified against the key of the rail the instruction went over
+	rail, railErr := t.getPaymentRail(stub, bondId, currency)
+	if rail != nil {
+		instruction.Rail = rail.Name()
+	}
 
-	args = append(args, []byte("submitPayment"))
-	args = append(args, []byte(newOwnerId))
-	args = append(args, []byte(trade_.SellerId))
-	//  1000 * trade_.Price =  ( 100000 / 100 ) * trade_.Price
-	args = append(args, []byte(strconv.FormatUint(1000 * trade_.Price , 10)))
-	args = append(args, []byte("payment"))
-	args = append(args, []byte(trade_.ContractId))
-	chainId, _ := t.getCallBackChaincodeId(stub)
-	args = append(args, []byte(chainId))
-	args = append(args, []byte("confirm"))
-	args = append(args, []byte(trade_.ContractId))
+	matched, err := t.screenMembers(stub, instruction.Payer, instruction.Payee)
+	if err != nil {
+		return instruction, err
+	}
+	if matched != "" {
+		instruction.Status = "held"
+		instruction.Reason = "sanctions list match: " + matched
+	}
+	log.Debugf("payment instruction: %+v", instruction)
+
+	if ok, err := stub.InsertRow("Payments", instruction.toRow()); !ok {
+		if err == nil {
+			err = errors.New("duplicate payment instruction " + instruction.Payload)
+		}
+		log.Error("Failed inserting payment instruction: " + err.Error())
+		return instruction, err
+	}
+	if matched != "" {
+		log.Errorf("payment instruction %s held: %s matches sanctions list", instruction.Payload, matched)
+		return instruction, nil
+	}
+
+	return instruction, t.sendPayment(stub, instruction, rail, railErr)
+}
+
+// sendPayment submits a recorded instruction over the rail. A rail refusing
+// the instruction does not fail the transaction, the instruction is recorded
+// as failed and handled as if the rail had called paymentFailed.
+func (t *BondChaincode) sendPayment(stub shim.ChaincodeStubInterface, instruction paymentInstruction, rail PaymentRail, err error) (error) {
+	if err == nil {
+		log.Debugf("submitting payment over %s rail", rail.Name())
+		err = rail.Submit(stub, instruction)
+	}
+	if err == nil {
+		return nil
+	}
+	log.Error("Failed submitting payment instruction: " + err.Error())
 
-	response, err := stub.InvokeChaincode(t.GetSwiftChaincodeToCall(), args)
+	// rails settling in the transaction may have changed the status already
+	failed, getErr := t.getPayment(stub, instruction.Payload)
+	if getErr != nil {
+		return getErr
+	}
+	if failed.Status != "submitted" {
+		return nil
+	}
+	failed.Status = "failed"
+	failed.Reason = err.Error()
+	if err := t.updatePayment(stub, failed); err != nil {
+		return err
+	}
+	return t.applyPaymentFailure(stub, failed)
+}
+
+func (t *BondChaincode) getPayment(stub shim.ChaincodeStubInterface, instructionId string) (paymentInstruction, error) {
+	id, err := strconv.ParseUint(instructionId, 10, 64)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return errors.New(errStr)
+		return paymentInstruction{}, errors.New("Incorrect instructionId. Uint64 expected.")
 	}
 
-	log.Debugf("Invoke chaincode successful. Got response %s", string(response))
+	var columns []shim.Column
+	columnID := shim.Column{Value: &shim.Column_Uint64{Uint64: id}}
+	columns = append(columns, columnID)
 
+	row, err := stub.GetRow("Payments", columns)
+	if err != nil {
+		message := "Failed retrieving payment instruction. Error: " + err.Error()
+		log.Error(message)
+		return paymentInstruction{}, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return paymentInstruction{}, errors.New("No payment instruction found for id " + instructionId)
+	}
+
+	var result paymentInstruction
+	result.readFromRow(row)
+	return result, nil
+}
+
+func (t *BondChaincode) updatePayment(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	log.Debugf("updatePayment: %+v", instruction)
+
+	if ok, err := stub.ReplaceRow("Payments", instruction.toRow()); !ok {
+		if err == nil {
+			err = errors.New("payment instruction " + instruction.Payload + " not found")
+		}
+		log.Error("Failed updating payment instruction: " + err.Error())
+		return err
+	}
 	return nil
 }
+
+// confirmPayment marks the instruction a callback refers to as confirmed. The
+// amount paid must match the instruction and an instruction is confirmed only
+// once so that retried or replayed callbacks are rejected.
+func (t *BondChaincode) confirmPayment(stub shim.ChaincodeStubInterface, instructionId string, callback string, amount uint64) (paymentInstruction, error) {
+	instruction, err := t.getPayment(stub, instructionId)
+	if err != nil {
+		return instruction, err
+	}
+	if instruction.Callback != callback {
+		return instruction, errors.New("Payment instruction " + instructionId + " is not confirmed by " + callback)
+	}
+	if instruction.Status != "submitted" {
+		return instruction, errors.New("Payment instruction " + instructionId + " is already " + instruction.Status)
+	}
+	if instruction.Amount != amount {
+		return instruction, errors.New("Payment instruction " + instructionId + " expects amount " + strconv.FormatUint(instruction.Amount, 10) + ", got " + strconv.FormatUint(amount, 10))
+	}
+
+	instruction.Status = "confirmed"
+	return instruction, t.updatePayment(stub, instruction)
+}
+
+// cancelTradePayments ends the instructions of a trade that will not settle:
+// those not paid yet are withdrawn and fees paid already are refunded.
+func (t *BondChaincode) cancelTradePayments(stub shim.ChaincodeStubInterface, tradeId uint64, reason string) (error) {
+	payments, err := t.getPayments(stub, "", "")
+	if err != nil {
+		return err
+	}
+
+	for _, instruction := range payments {
+		if instruction.TradeId != tradeId {
+			continue
+		}
+		if instruction.Status == "submitted" || instruction.Status == "held" {
+			instruction.Status = "cancelled"
+			instruction.Reason = reason
+			if err := t.updatePayment(stub, instruction); err != nil {
+				return err
+			}
+		} else if instruction.Status == "confirmed" && instruction.Callback == "payFee" {
+			if err := t.refundPayment(stub, instruction, instruction.Amount, reason); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refundPayment pays back the amount received on an instruction whose
+// purpose is gone, e.g. a payment for a trade released before it arrived.
+func (t *BondChaincode) refundPayment(stub shim.ChaincodeStubInterface, instruction paymentInstruction, amount uint64, reason string) (error) {
+	log.Warningf("refundPayment %s of %d: %s", instruction.Payload, amount, reason)
+
+	instruction.Status = "refunded"
+	instruction.Reason = reason
+	if err := t.updatePayment(stub, instruction); err != nil {
+		return err
+	}
+
+	// the refund goes over the rail of the bond the instruction was for
+	var bondId string
+	if contract_, err := t.getContractById(stub, instruction.Reference); err == nil {
+		bondId = contract_.BondId
+	}
+	_, err := t.submitPayment(stub, bondId, instruction.Currency, paymentInstruction{
+		Payer: 		instruction.Payee,
+		Payee: 		instruction.Payer,
+		Amount: 	amount,
+		Currency: 	instruction.Currency,
+		Purpose: 	"refund",
+		Reference: 	instruction.Payload,
+		TradeId: 	instruction.TradeId,
+		Callback: 	"payRefund"})
+	return err
+}
+
+// releaseHeldPayment sends an instruction held on a sanctions match over its rail after review.
+func (t *BondChaincode) releaseHeldPayment(stub shim.ChaincodeStubInterface, instructionId string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "releaseHeldPayment", instructionId)
+
+	instruction, err := t.getPayment(stub, instructionId)
+	if err != nil {
+		return nil, err
+	}
+	if instruction.Status != "held" {
+		return nil, errors.New("Payment instruction " + instructionId + " is " + instruction.Status + ", only held payments can be released")
+	}
+
+	instruction.Status = "submitted"
+	instruction.Reason = ""
+	if err := t.updatePayment(stub, instruction); err != nil {
+		return nil, err
+	}
+
+	rail, railErr := t.newPaymentRail(instruction.Rail)
+	return nil, t.sendPayment(stub, instruction, rail, railErr)
+}
+
+// rejectHeldPayment drops an instruction held on a sanctions match as if it failed.
+func (t *BondChaincode) rejectHeldPayment(stub shim.ChaincodeStubInterface, instructionId string, reason string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s", "rejectHeldPayment", instructionId, reason)
+
+	instruction, err := t.getPayment(stub, instructionId)
+	if err != nil {
+		return nil, err
+	}
+	if instruction.Status != "held" {
+		return nil, errors.New("Payment instruction " + instructionId + " is " + instruction.Status + ", only held payments can be rejected")
+	}
+
+	instruction.Status = "rejected"
+	instruction.Reason = reason
+	if err := t.updatePayment(stub, instruction); err != nil {
+		return nil, err
+	}
+
+	return nil, t.applyPaymentFailure(stub, instruction)
+}
+
+// payRefund is called back by the rail once a refund was paid back.
+func (t *BondChaincode) payRefund(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %d", "payRefund", instructionId, amount)
+
+	if _, err := t.confirmPayment(stub, instructionId, "payRefund", amount); err != nil {
+		message := "Failed confirming refund. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	return nil, nil
+}
+
+// paymentFailed is called back by a rail that could not move the money. A
+// failed trade payment releases the reservation, a failed coupon is missed.
+func (t *BondChaincode) paymentFailed(stub shim.ChaincodeStubInterface, instructionId string, reason string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s", "paymentFailed", instructionId, reason)
+
+	instruction, err := t.getPayment(stub, instructionId)
+	if err != nil {
+		return nil, err
+	}
+	// rails retry callbacks, a repeated failure changes nothing
+	if instruction.Status == "failed" {
+		log.Warningf("paymentFailed for instruction %s failed already", instructionId)
+		return nil, nil
+	}
+	if instruction.Status != "submitted" && instruction.Status != "cancelled" {
+		return nil, errors.New("Payment instruction " + instructionId + " is already " + instruction.Status)
+	}
+	cancelled := instruction.Status == "cancelled"
+
+	instruction.Status = "failed"
+	instruction.Reason = reason
+	if err := t.updatePayment(stub, instruction); err != nil {
+		return nil, err
+	}
+	// the trade of a cancelled instruction was released already
+	if cancelled {
+		return nil, nil
+	}
+
+	return nil, t.applyPaymentFailure(stub, instruction)
+}
+
+// applyPaymentFailure undoes what a payment that will not arrive was for: a
+// trade payment releases the reservation, a coupon is missed.
+func (t *BondChaincode) applyPaymentFailure(stub shim.ChaincodeStubInterface, instruction paymentInstruction) (error) {
+	if instruction.Callback == "confirm" {
+		trade_, err := t.getTradeByType(stub, "reserved", instruction.TradeId)
+		if err != nil {
+			// the trade expired or was released already, the failure is only recorded
+			log.Warningf("applyPaymentFailure for trade %d no longer reserved: %s", instruction.TradeId, err.Error())
+			return nil
+		}
+		return t.releaseTrade(stub, trade_)
+	} else if instruction.Callback == "payContractCoupon" {
+		contract_, err := t.getContractById(stub, instruction.Reference)
+		if err != nil {
+			return err
+		}
+		// arrears were accrued when the coupon was instructed
+		return t.missContractCoupon(stub, contract_, 0)
+	} else if instruction.Callback == "payNettedCoupons" {
+		for _, allocation := range instruction.Allocations {
+			contract_, err := t.getContractById(stub, allocation.ContractId)
+			if err != nil {
+				return err
+			}
+			if err := t.missContractCoupon(stub, contract_, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// paymentReversed is called back by a rail when a confirmed payment is taken
+// back. A reversed trade payment returns the contract to the seller if the
+// buyer still holds it, a reversed coupon counts as missed.
+func (t *BondChaincode) paymentReversed(stub shim.ChaincodeStubInterface, instructionId string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "paymentReversed", instructionId)
+
+	instruction, err := t.getPayment(stub, instructionId)
+	if err != nil {
+		return nil, err
+	}
+	if instruction.Status == "reversed" {
+		log.Warningf("paymentReversed for instruction %s reversed already", instructionId)
+		return nil, nil
+	}
+	if instruction.Status != "confirmed" {
+		return nil, errors.New("Payment instruction " + instructionId + " is " + instruction.Status + ", only confirmed payments can be reversed")
+	}
+
+	instruction.Status = "reversed"
+	if err := t.updatePayment(stub, instruction); err != nil {
+		return nil, err
+	}
+
+	if instruction.Callback == "confirm" {
+		trade_, err := t.getTradeByType(stub, "settled", instruction.TradeId)
+		if err != nil {
+			// the trade failed or was reversed already, the reversal is only recorded
+			log.Warningf("paymentReversed for trade %d not settled: %s", instruction.TradeId, err.Error())
+			return nil, nil
+		}
+		contract_, err := t.getContractById(stub, trade_.ContractId)
+		if err != nil {
+			return nil, err
+		}
+		if contract_.OwnerId != trade_.BuyerId || contract_.State != "active" {
+			log.Warningf("paymentReversed cannot return contract %s to %s, it is %s by %s", contract_.Id, trade_.SellerId, contract_.State, contract_.OwnerId)
+			return nil, nil
+		}
+
+		contract_.OwnerId = trade_.SellerId
+		contract_.OwnerCompany = trade_.SellerCompany
+		if _, err := t.updateContract(stub, contract_); err != nil {
+			return nil, err
+		}
+		trade_.State = "reversed"
+		if err := t.updateTrade(stub, trade_); err != nil {
+			return nil, err
+		}
+		return nil, t.cancelTradePayments(stub, trade_.Id, "trade reversed")
+	} else if instruction.Callback == "payContractCoupon" {
+		contract_, err := t.getContractById(stub, instruction.Reference)
+		if err != nil {
+			return nil, err
+		}
+		if contract_.CouponsPaid > 0 {
+			contract_.CouponsPaid--
+		}
+		return nil, t.missContractCoupon(stub, contract_, instruction.Amount)
+	} else if instruction.Callback == "payNettedCoupons" {
+		for _, allocation := range instruction.Allocations {
+			contract_, err := t.getContractById(stub, allocation.ContractId)
+			if err != nil {
+				return nil, err
+			}
+			if contract_.CouponsPaid > 0 {
+				contract_.CouponsPaid--
+			}
+			if err := t.missContractCoupon(stub, contract_, allocation.Amount); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *BondChaincode) getPayments(stub shim.ChaincodeStubInterface, memberId string, status string) (payments []paymentInstruction, err error) {
+	rows, err := stub.GetRows("Payments", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving payments. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result paymentInstruction
+		result.readFromRow(row)
+		if memberId != "" && result.Payer != memberId && result.Payee != memberId {
+			continue
+		}
+		if status != "" && result.Status != status {
+			continue
+		}
+		payments = append(payments, result)
+	}
+
+	return payments, nil
+}
+
+// paymentCallback runs a payment confirmation for rails that settle within the transaction.
+func (t *BondChaincode) paymentCallback(stub shim.ChaincodeStubInterface, callback string, payload string, amount uint64) (error) {
+	log.Debugf("paymentCallback: %s(%s, %d)", callback, payload, amount)
+
+	if callback == "confirm" {
+		_, err := t.confirm(stub, payload, amount)
+		return err
+	} else if callback == "payContractCoupon" {
+		_, err := t.payContractCoupon(stub, payload, amount)
+		return err
+	} else if callback == "payNettedCoupons" {
+		_, err := t.payNettedCoupons(stub, payload, amount)
+		return err
+	} else if callback == "payFee" {
+		_, err := t.payFee(stub, payload, amount)
+		return err
+	} else if callback == "payWithholding" {
+		_, err := t.payWithholding(stub, payload, amount)
+		return err
+	} else if callback == "payRefund" {
+		_, err := t.payRefund(stub, payload, amount)
+		return err
+	}
+	return errors.New("Unknown payment callback " + callback)
+}
+
+func (t *BondChaincode) setPaymentRail(stub shim.ChaincodeStubInterface, scope string, key string, railName string) (error) {
+	if scope != "bond" && scope != "currency" {
+		return errors.New("Incorrect scope. Expecting bond or currency.")
+	}
+	if _, err := t.newPaymentRail(railName); err != nil {
+		return err
+	}
+	return stub.PutState("rail." + scope + "." + key, []byte(railName))
+}
+
+// getPaymentRail picks the rail set for the bond, then the one set for the currency, then swift.
+func (t *BondChaincode) getPaymentRail(stub shim.ChaincodeStubInterface, bondId string, currency string) (PaymentRail, error) {
+	railName, err := stub.GetState("rail.bond." + bondId)
+	if err != nil {
+		return nil, err
+	}
+	if len(railName) == 0 && currency != "" {
+		railName, err = stub.GetState("rail.currency." + currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(railName) == 0 {
+		railName = []byte(SWIFT_RAIL)
+	}
+	return t.newPaymentRail(string(railName))
+}
+
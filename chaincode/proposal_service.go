@@ -0,0 +1,258 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Bonds are issued under four-eyes control. createBond only files a proposal
+// in draft. The proposal needs the approval of a second issuer user of the
+// proposer's company and, if an arranger bank is named, of the arranger. The
+// bond and its contracts are issued once all approvals are in. Either approver
+// may reject the proposal instead.
+
+type proposal struct {
+	Id                 uint64 `json:"id"`
+	ProposerId         string `json:"proposerId"`
+	Company            string `json:"company"`
+	Arranger           string `json:"arranger"`
+	State              string `json:"state"`
+	ApprovedBy         string `json:"approvedBy"`
+	ArrangerApprovedBy string `json:"arrangerApprovedBy"`
+	RejectedBy         string `json:"rejectedBy"`
+	Reason             string `json:"reason"`
+	Timestamp          uint64 `json:"timestamp"`
+	Bond               bond   `json:"bond"`
+	Restriction        transferRestriction `json:"restriction"`
+}
+
+func (proposal_ *proposal) readFromRow(row shim.Row) {
+	proposal_.Id 			= row.Columns[0].GetUint64()
+	proposal_.ProposerId 		= row.Columns[1].GetString_()
+	proposal_.Company 		= row.Columns[2].GetString_()
+	proposal_.Arranger 		= row.Columns[3].GetString_()
+	proposal_.State 		= row.Columns[4].GetString_()
+	proposal_.ApprovedBy 		= row.Columns[5].GetString_()
+	proposal_.ArrangerApprovedBy 	= row.Columns[6].GetString_()
+	proposal_.RejectedBy 		= row.Columns[7].GetString_()
+	proposal_.Reason 		= row.Columns[8].GetString_()
+	proposal_.Timestamp 		= row.Columns[9].GetUint64()
+	json.Unmarshal([]byte(row.Columns[10].GetString_()), &proposal_.Bond)
+	json.Unmarshal([]byte(row.Columns[11].GetString_()), &proposal_.Restriction)
+}
+
+func (proposal_ *proposal) toRow() (shim.Row) {
+	bondBytes, _ := json.Marshal(proposal_.Bond)
+	restrictionBytes, _ := json.Marshal(proposal_.Restriction)
+
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: proposal_.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.ProposerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.Company}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.Arranger}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.State}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.ApprovedBy}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.ArrangerApprovedBy}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.RejectedBy}},
+			&shim.Column{Value: &shim.Column_String_{String_: proposal_.Reason}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: proposal_.Timestamp}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(bondBytes)}},
+			&shim.Column{Value: &shim.Column_String_{String_: string(restrictionBytes)}}},
+	}
+}
+
+func (t *BondChaincode) initProposals(stub shim.ChaincodeStubInterface) (error) {
+	// Create proposals table
+	err := stub.CreateTable("Proposals", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: "ProposerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Company", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Arranger", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "ApprovedBy", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "ArrangerApprovedBy", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "RejectedBy", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Bond", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Restriction", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Proposals")
+		return errors.New("Failed creating Proposals table.")
+	}
+
+	err = stub.PutState("ProposalsCounter", []byte(strconv.FormatUint(0, 10)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// proposeBond files the bond in a draft proposal and returns the proposal id.
+func (t *BondChaincode) proposeBond(stub shim.ChaincodeStubInterface, bond_ bond, proposerCompany string, arranger string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "proposeBond", bond_.Id)
+
+	if proposerCompany == "" {
+		return nil, errors.New("Bond cannot be proposed by an issuer without company")
+	}
+
+	counter, err := t.incrementAndGetCounter(stub, "ProposalsCounter")
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal_ := proposal{
+		Id: 		counter,
+		ProposerId: 	bond_.IssuerId,
+		Company: 	proposerCompany,
+		Arranger: 	arranger,
+		State: 		"draft",
+		Timestamp: 	now,
+		Bond: 		bond_}
+
+	if ok, err := stub.InsertRow("Proposals", proposal_.toRow()); !ok {
+		if err == nil {
+			err = errors.New("duplicate proposal " + strconv.FormatUint(counter, 10))
+		}
+		log.Error("Failed inserting new proposal: " + err.Error())
+		return nil, err
+	}
+
+	return []byte(strconv.FormatUint(counter, 10)), nil
+}
+
+func (t *BondChaincode) approveBond(stub shim.ChaincodeStubInterface, proposalId string, callerName string, callerRole string, callerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "approveBond", proposalId)
+
+	proposal_, err := t.getProposal(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	if proposal_.State != "draft" {
+		return nil, errors.New("Proposal " + proposalId + " is already " + proposal_.State)
+	}
+
+	// an arranger may hold the issuer role too, it approves as the arranger named
+	if proposal_.Arranger != "" && callerName == proposal_.Arranger {
+		proposal_.ArrangerApprovedBy = callerName
+	} else if callerRole == "issuer" {
+		if callerName == proposal_.ProposerId {
+			return nil, errors.New("Proposal must be approved by an issuer other than its proposer")
+		}
+		if callerCompany != proposal_.Company {
+			return nil, errors.New("Proposal must be approved by an issuer of company " + proposal_.Company)
+		}
+		proposal_.ApprovedBy = callerName
+	} else {
+		return nil, errors.New("Only an issuer of the company or the arranger can approve proposal " + proposalId)
+	}
+
+	if proposal_.ApprovedBy != "" && (proposal_.Arranger == "" || proposal_.ArrangerApprovedBy != "") {
+		if _, err := t.createBond(stub, proposal_.Bond); err != nil {
+			return nil, err
+		}
+		if _, err := t.createContractsForBond(stub, proposal_.Bond, proposal_.Bond.Principal/PRICE_PER_CONTRACT, proposal_.Company); err != nil {
+			return nil, err
+		}
+		if err := t.createRestriction(stub, proposal_.Restriction); err != nil {
+			return nil, err
+		}
+		proposal_.State = "issued"
+	}
+
+	return nil, t.updateProposal(stub, proposal_)
+}
+
+func (t *BondChaincode) rejectBond(stub shim.ChaincodeStubInterface, proposalId string, reason string, callerName string, callerRole string, callerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %s", "rejectBond", proposalId, reason)
+
+	proposal_, err := t.getProposal(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	if proposal_.State != "draft" {
+		return nil, errors.New("Proposal " + proposalId + " is already " + proposal_.State)
+	}
+
+	companyIssuer := callerRole == "issuer" && callerCompany == proposal_.Company
+	if !companyIssuer && (proposal_.Arranger == "" || callerName != proposal_.Arranger) {
+		return nil, errors.New("Only an issuer of the company or the arranger can reject proposal " + proposalId)
+	}
+
+	proposal_.State = "rejected"
+	proposal_.RejectedBy = callerName
+	proposal_.Reason = reason
+
+	return nil, t.updateProposal(stub, proposal_)
+}
+
+func (t *BondChaincode) updateProposal(stub shim.ChaincodeStubInterface, proposal_ proposal) (error) {
+	log.Debugf("updateProposal: %+v", proposal_)
+
+	if ok, err := stub.ReplaceRow("Proposals", proposal_.toRow()); !ok {
+		if err == nil {
+			err = errors.New("proposal " + strconv.FormatUint(proposal_.Id, 10) + " not found")
+		}
+		log.Error("Failed updating proposal: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+func (t *BondChaincode) getProposal(stub shim.ChaincodeStubInterface, proposalId string) (proposal, error) {
+	id, err := strconv.ParseUint(proposalId, 10, 64)
+	if err != nil {
+		return proposal{}, errors.New("Incorrect proposalId. Uint64 expected.")
+	}
+
+	var columns []shim.Column
+	columnID := shim.Column{Value: &shim.Column_Uint64{Uint64: id}}
+	columns = append(columns, columnID)
+
+	row, err := stub.GetRow("Proposals", columns)
+	if err != nil {
+		message := "Failed retrieving proposal. Error: " + err.Error()
+		log.Error(message)
+		return proposal{}, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return proposal{}, errors.New("No proposal found for id " + proposalId)
+	}
+
+	var result proposal
+	result.readFromRow(row)
+	return result, nil
+}
+
+// getProposals returns proposals of the company, or those the arranger is named in if company is empty.
+func (t *BondChaincode) getProposals(stub shim.ChaincodeStubInterface, company string, arranger string) (proposals []proposal, err error) {
+	rows, err := stub.GetRows("Proposals", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving proposals. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result proposal
+		result.readFromRow(row)
+		if company != "" && result.Company != company {
+			continue
+		}
+		if arranger != "" && result.Arranger != arranger {
+			continue
+		}
+		proposals = append(proposals, result)
+	}
+
+	return proposals, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Issuers may restrict secondary trading of a bond. The rules are attached to
+// the bond's proposal before it is approved and take effect once the bond is
+// issued. Investors cannot sell until the lock-up ends, contracts can only be
+// bought by investors of the jurisdictions listed and by no more holders than
+// the maximum. Zero or empty values leave a rule out.
+
+type transferRestriction struct {
+	BondId        string   `json:"bondId"`
+	LockupEnd     uint64   `json:"lockupEnd"`
+	Jurisdictions []string `json:"jurisdictions"`
+	MaxHolders    uint64   `json:"maxHolders"`
+}
+
+func (restriction *transferRestriction) readFromRow(row shim.Row) {
+	restriction.BondId 		= row.Columns[0].GetString_()
+	restriction.LockupEnd 		= row.Columns[1].GetUint64()
+	restriction.Jurisdictions 	= splitJurisdictions(row.Columns[2].GetString_())
+	restriction.MaxHolders 		= row.Columns[3].GetUint64()
+}
+
+func (restriction *transferRestriction) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: restriction.BondId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: restriction.LockupEnd}},
+			&shim.Column{Value: &shim.Column_String_{String_: strings.Join(restriction.Jurisdictions, ",")}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: restriction.MaxHolders}}},
+	}
+}
+
+func (restriction *transferRestriction) isEmpty() (bool) {
+	return restriction.LockupEnd == 0 && len(restriction.Jurisdictions) == 0 && restriction.MaxHolders == 0
+}
+
+func splitJurisdictions(jurisdictions string) ([]string) {
+	if jurisdictions == "" {
+		return nil
+	}
+	return strings.Split(jurisdictions, ",")
+}
+
+func (t *BondChaincode) initRestrictions(stub shim.ChaincodeStubInterface) (error) {
+	// Create restrictions table
+	err := stub.CreateTable("Restrictions", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BondId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "LockupEnd", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Jurisdictions", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "MaxHolders", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Restrictions")
+		return errors.New("Failed creating Restrictions table.")
+	}
+
+	return nil
+}
+
+// restrictBond attaches the rules to a draft proposal not approved by anyone yet.
+func (t *BondChaincode) restrictBond(stub shim.ChaincodeStubInterface, proposalId string, restriction transferRestriction, callerName string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %+v", "restrictBond", proposalId, restriction)
+
+	proposal_, err := t.getProposal(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	if proposal_.ProposerId != callerName {
+		return nil, errors.New("Only the proposer can restrict proposal " + proposalId)
+	}
+	if proposal_.State != "draft" {
+		return nil, errors.New("Proposal " + proposalId + " is already " + proposal_.State)
+	}
+	if proposal_.ApprovedBy != "" || proposal_.ArrangerApprovedBy != "" {
+		return nil, errors.New("Proposal " + proposalId + " cannot be changed once approved")
+	}
+
+	restriction.BondId = proposal_.Bond.Id
+	proposal_.Restriction = restriction
+
+	return nil, t.updateProposal(stub, proposal_)
+}
+
+func (t *BondChaincode) createRestriction(stub shim.ChaincodeStubInterface, restriction transferRestriction) (error) {
+	if restriction.isEmpty() {
+		return nil
+	}
+	if ok, err := stub.InsertRow("Restrictions", restriction.toRow()); !ok {
+		if err == nil {
+			err = errors.New("Bond " + restriction.BondId + " is restricted already")
+		}
+		log.Error("Failed inserting restriction: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// getRestriction returns an empty restriction for bonds traded freely.
+func (t *BondChaincode) getRestriction(stub shim.ChaincodeStubInterface, bondId string) (transferRestriction, error) {
+	var columns []shim.Column
+	columnBondId := shim.Column{Value: &shim.Column_String_{String_: bondId}}
+	columns = append(columns, columnBondId)
+
+	row, err := stub.GetRow("Restrictions", columns)
+	if err != nil {
+		message := "Failed retrieving restriction. Error: " + err.Error()
+		log.Error(message)
+		return transferRestriction{}, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return transferRestriction{BondId: bondId}, nil
+	}
+
+	var result transferRestriction
+	result.readFromRow(row)
+	return result, nil
+}
+
+// checkLockup rejects secondary trades of the contract before the lock-up ends, the issuer may still place it.
+func (t *BondChaincode) checkLockup(stub shim.ChaincodeStubInterface, contract_ contract, sellerId string, now uint64) (error) {
+	if sellerId == contract_.IssuerId {
+		return nil
+	}
+	restriction, err := t.getRestriction(stub, contract_.BondId)
+	if err != nil {
+		return err
+	}
+	if now < restriction.LockupEnd {
+		return rejectTrade("LOCKUP", "Bond " + contract_.BondId + " cannot be traded until " + strconv.FormatUint(restriction.LockupEnd, 10))
+	}
+	return nil
+}
+
+// checkRestriction evaluates the rules of the contract's bond for a trade to the buyer.
+func (t *BondChaincode) checkRestriction(stub shim.ChaincodeStubInterface, trade_ trade, contract_ contract, buyerId string, now uint64) (error) {
+	if err := t.checkLockup(stub, contract_, trade_.SellerId, now); err != nil {
+		return err
+	}
+	restriction, err := t.getRestriction(stub, contract_.BondId)
+	if err != nil {
+		return err
+	}
+
+	if len(restriction.Jurisdictions) > 0 {
+		buyer, err := t.getMember(stub, buyerId)
+		if err != nil {
+			return err
+		}
+		allowed := false
+		for _, jurisdiction := range restriction.Jurisdictions {
+			if buyer.Jurisdiction == jurisdiction {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return rejectTrade("JURISDICTION_RESTRICTED", "Bond " + contract_.BondId + " cannot be bought by investors of jurisdiction '" + buyer.Jurisdiction + "'")
+		}
+	}
+
+	if restriction.MaxHolders > 0 {
+		holders, err := t.getBondHolders(stub, contract_.BondId, contract_.IssuerId)
+		if err != nil {
+			return err
+		}
+		// selling the last contract of a holder frees its place
+		if contract_.OwnerId != contract_.IssuerId && holders[contract_.OwnerId] == 1 {
+			delete(holders, contract_.OwnerId)
+		}
+		if _, ok := holders[buyerId]; !ok && uint64(len(holders)) >= restriction.MaxHolders {
+			return rejectTrade("MAX_HOLDERS", "Bond " + contract_.BondId + " is held by " + strconv.Itoa(len(holders)) + " investors, its maximum is " + strconv.FormatUint(restriction.MaxHolders, 10))
+		}
+	}
+
+	return nil
+}
+
+// getBondHolders counts contracts of the bond per investor holding or buying them.
+func (t *BondChaincode) getBondHolders(stub shim.ChaincodeStubInterface, bondId string, issuerId string) (map[string]int, error) {
+	contracts, err := t.getIssuerContracts(stub, issuerId)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := t.getPendingTrades(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make(map[string]int)
+	for _, contract_ := range contracts {
+		if contract_.BondId == bondId && contract_.OwnerId != issuerId {
+			holders[contract_.OwnerId]++
+		}
+	}
+	for _, trade_ := range pending {
+		if strings.HasPrefix(trade_.ContractId, bondId + ".") {
+			holders[trade_.BuyerId]++
+		}
+	}
+	return holders, nil
+}
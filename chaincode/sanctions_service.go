@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Counterparties of a trade and of every payment are screened against the
+// sanctions list before a payment is instructed. The list is published by a compliance oracle as
+// hex sha256 hashes of member ids so that names do not go on the ledger. Each
+// publication carries a version; a higher version replaces the list, hashes
+// published under the current version again are added to it, possibly over
+// several transactions. A trade or payment matching the list is held for
+// review by compliance, who release it to go ahead or reject it.
+
+type sanction struct {
+	Hash    string `json:"hash"`
+	Version uint64 `json:"version"`
+}
+
+func (sanction_ *sanction) readFromRow(row shim.Row) {
+	sanction_.Hash 		= row.Columns[0].GetString_()
+	sanction_.Version 	= row.Columns[1].GetUint64()
+}
+
+func (sanction_ *sanction) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: sanction_.Hash}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: sanction_.Version}}},
+	}
+}
+
+func (t *BondChaincode) initSanctions(stub shim.ChaincodeStubInterface) (error) {
+	// Create sanctions table
+	err := stub.CreateTable("Sanctions", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Hash", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Version", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Sanctions")
+		return errors.New("Failed creating Sanctions table.")
+	}
+
+	err = stub.PutState("sanctionsversion", []byte(strconv.FormatUint(0, 10)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) getSanctionsVersion(stub shim.ChaincodeStubInterface) (uint64, error) {
+	versionBytes, err := stub.GetState("sanctionsversion")
+	if err != nil {
+		log.Error("Failed retrieving sanctions version. Error: " + err.Error())
+		return 0, err
+	}
+	return strconv.ParseUint(string(versionBytes), 10, 64)
+}
+
+func (t *BondChaincode) publishSanctions(stub shim.ChaincodeStubInterface, version uint64, hashes []string) ([]byte, error) {
+	log.Debugf("function: %s, args: %d, %d hashes", "publishSanctions", version, len(hashes))
+
+	current, err := t.getSanctionsVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, errors.New("Incorrect version. Expecting a version above 0.")
+	}
+	if version < current {
+		return nil, errors.New("Sanctions list version " + strconv.FormatUint(current, 10) + " is published already")
+	}
+
+	for _, hash := range hashes {
+		// hashes are looked up hex encoded in lower case
+		hash = strings.ToLower(hash)
+		if hashBytes, err := hex.DecodeString(hash); err != nil || len(hashBytes) != sha256.Size {
+			return nil, errors.New("Incorrect hash " + hash + ". Hex encoded sha256 expected.")
+		}
+		sanction_ := sanction{Hash: hash, Version: version}
+		ok, err := stub.InsertRow("Sanctions", sanction_.toRow())
+		if err != nil {
+			log.Error("Failed inserting sanction: " + err.Error())
+			return nil, err
+		}
+		if !ok {
+			if _, err := stub.ReplaceRow("Sanctions", sanction_.toRow()); err != nil {
+				log.Error("Failed replacing sanction: " + err.Error())
+				return nil, err
+			}
+		}
+	}
+
+	return nil, stub.PutState("sanctionsversion", []byte(strconv.FormatUint(version, 10)))
+}
+
+// isSanctioned matches the member id against the current version of the list.
+func (t *BondChaincode) isSanctioned(stub shim.ChaincodeStubInterface, memberId string, version uint64) (bool, error) {
+	hash := sha256.Sum256([]byte(memberId))
+
+	var columns []shim.Column
+	columnHash := shim.Column{Value: &shim.Column_String_{String_: hex.EncodeToString(hash[:])}}
+	columns = append(columns, columnHash)
+
+	row, err := stub.GetRow("Sanctions", columns)
+	if err != nil {
+		message := "Failed retrieving sanction. Error: " + err.Error()
+		log.Error(message)
+		return false, errors.New(message)
+	}
+	if len(row.Columns) == 0 {
+		return false, nil
+	}
+
+	var result sanction
+	result.readFromRow(row)
+	return result.Version == version, nil
+}
+
+// screenTrade returns the buyer or seller of the trade on the sanctions list, or an empty string.
+func (t *BondChaincode) screenTrade(stub shim.ChaincodeStubInterface, trade_ trade) (string, error) {
+	return t.screenMembers(stub, trade_.BuyerId, trade_.SellerId)
+}
+
+// screenMembers returns the first of the members on the sanctions list, or an empty string.
+func (t *BondChaincode) screenMembers(stub shim.ChaincodeStubInterface, memberIds ...string) (string, error) {
+	version, err := t.getSanctionsVersion(stub)
+	if err != nil || version == 0 {
+		return "", err
+	}
+
+	for _, memberId := range memberIds {
+		sanctioned, err := t.isSanctioned(stub, memberId, version)
+		if err != nil {
+			return "", err
+		}
+		if sanctioned {
+			return memberId, nil
+		}
+	}
+	return "", nil
+}
+
+// releaseHeldTrade lets a held trade settle, its payment is instructed as at buy.
+func (t *BondChaincode) releaseHeldTrade(stub shim.ChaincodeStubInterface, tradeId uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %d", "releaseHeldTrade", tradeId)
+
+	trade_, err := t.getTradeByType(stub, "held", tradeId)
+	if err != nil {
+		return nil, err
+	}
+	contract_, err := t.getContractById(stub, trade_.ContractId)
+	if err != nil {
+		return nil, err
+	}
+	fee, err := t.getTradeFee(stub, trade_, contract_, trade_.CleanAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	settlementPeriod, err := t.getSettlementPeriod(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// settlement period starts over from the release
+	trade_.State = "reserved"
+	trade_.SettleBy = now + settlementPeriod
+	if err := t.updateTrade(stub, trade_); err != nil {
+		return nil, err
+	}
+
+	return nil, t.submitTradePayments(stub, trade_, contract_, fee)
+}
+
+// rejectHeldTrade cancels a held trade, the contract stays with the seller and
+// is no longer offered unless the seller is its issuer.
+func (t *BondChaincode) rejectHeldTrade(stub shim.ChaincodeStubInterface, tradeId uint64, reason string) ([]byte, error) {
+	log.Debugf("function: %s, args: %d, %s", "rejectHeldTrade", tradeId, reason)
+
+	trade_, err := t.getTradeByType(stub, "held", tradeId)
+	if err != nil {
+		return nil, err
+	}
+	contract_, err := t.getContractById(stub, trade_.ContractId)
+	if err != nil {
+		return nil, err
+	}
+
+	trade_.State = "rejected"
+	if err := t.updateTrade(stub, trade_); err != nil {
+		return nil, err
+	}
+	if err := t.cancelTradePayments(stub, trade_.Id, "trade rejected: " + reason); err != nil {
+		return nil, err
+	}
+
+	// contracts not placed yet do not earn coupons, the issuer keeps them on offer
+	contract_.State = "active"
+	if contract_.OwnerId == contract_.IssuerId {
+		contract_.State = "offer"
+	}
+	if _, err := t.updateContract(stub, contract_); err != nil {
+		message := "Failed releasing contract. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	return nil, t.payDeferredCoupons(stub, contract_.Id)
+}
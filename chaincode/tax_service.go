@@ -0,0 +1,305 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Coupons are subject to withholding tax at the rate set for the issuer's and
+// the investor's jurisdictions. The investor is paid the net coupon and the
+// tax withheld goes to the tax authority account of the rate in a separate
+// instruction. Every withholding is recorded per investor for year-end tax
+// certificates.
+
+type withholdingRate struct {
+	IssuerJurisdiction   string `json:"issuerJurisdiction"`
+	InvestorJurisdiction string `json:"investorJurisdiction"`
+	RateBps              uint64 `json:"rateBps"`
+	Authority            string `json:"authority"`
+}
+
+type withholding struct {
+	InvestorId string `json:"investorId"`
+	Id         uint64 `json:"id"`
+	ContractId string `json:"contractId"`
+	BondId     string `json:"bondId"`
+	IssuerId   string `json:"issuerId"`
+	Currency   string `json:"currency"`
+	Gross      uint64 `json:"gross"`
+	RateBps    uint64 `json:"rateBps"`
+	Withheld   uint64 `json:"withheld"`
+	Authority  string `json:"authority"`
+	PaymentId  uint64 `json:"paymentId"`
+	Timestamp  uint64 `json:"timestamp"`
+	Year       uint64 `json:"year"`
+}
+
+func (rate *withholdingRate) readFromRow(row shim.Row) {
+	rate.IssuerJurisdiction 	= row.Columns[0].GetString_()
+	rate.InvestorJurisdiction 	= row.Columns[1].GetString_()
+	rate.RateBps 			= row.Columns[2].GetUint64()
+	rate.Authority 			= row.Columns[3].GetString_()
+}
+
+func (rate *withholdingRate) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: rate.IssuerJurisdiction}},
+			&shim.Column{Value: &shim.Column_String_{String_: rate.InvestorJurisdiction}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rate.RateBps}},
+			&shim.Column{Value: &shim.Column_String_{String_: rate.Authority}}},
+	}
+}
+
+func (withholding_ *withholding) readFromRow(row shim.Row) {
+	withholding_.InvestorId 	= row.Columns[0].GetString_()
+	withholding_.Id 		= row.Columns[1].GetUint64()
+	withholding_.ContractId 	= row.Columns[2].GetString_()
+	withholding_.BondId 		= row.Columns[3].GetString_()
+	withholding_.IssuerId 		= row.Columns[4].GetString_()
+	withholding_.Currency 		= row.Columns[5].GetString_()
+	withholding_.Gross 		= row.Columns[6].GetUint64()
+	withholding_.RateBps 		= row.Columns[7].GetUint64()
+	withholding_.Withheld 		= row.Columns[8].GetUint64()
+	withholding_.Authority 		= row.Columns[9].GetString_()
+	withholding_.PaymentId 		= row.Columns[10].GetUint64()
+	withholding_.Timestamp 		= row.Columns[11].GetUint64()
+	withholding_.Year 		= row.Columns[12].GetUint64()
+}
+
+func (withholding_ *withholding) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.InvestorId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.ContractId}},
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.BondId}},
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.IssuerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.Currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.Gross}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.RateBps}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.Withheld}},
+			&shim.Column{Value: &shim.Column_String_{String_: withholding_.Authority}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.PaymentId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.Timestamp}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: withholding_.Year}}},
+	}
+}
+
+func (t *BondChaincode) initWithholdings(stub shim.ChaincodeStubInterface) (error) {
+	// Create withholding rates table
+	err := stub.CreateTable("WithholdingRates", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "IssuerJurisdiction", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "InvestorJurisdiction", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "RateBps", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Authority", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize WithholdingRates")
+		return errors.New("Failed creating WithholdingRates table.")
+	}
+
+	// Create withholdings table
+	err = stub.CreateTable("Withholdings", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "InvestorId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: "ContractId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "BondId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "IssuerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Gross", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "RateBps", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Withheld", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Authority", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "PaymentId", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Year", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Withholdings")
+		return errors.New("Failed creating Withholdings table.")
+	}
+
+	err = stub.PutState("WithholdingsCounter", []byte(strconv.FormatUint(0, 10)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) setWithholdingRate(stub shim.ChaincodeStubInterface, rate withholdingRate) (error) {
+	if rate.RateBps > BPS_DIVISOR {
+		return errors.New("Incorrect rate. Expecting at most " + strconv.FormatUint(BPS_DIVISOR, 10) + " basis points.")
+	}
+	if rate.RateBps > 0 && rate.Authority == "" {
+		return errors.New("Incorrect withholding rate. Expecting a tax authority account.")
+	}
+	log.Debugf("setWithholdingRate: %+v", rate)
+
+	ok, err := stub.InsertRow("WithholdingRates", rate.toRow())
+	if err != nil {
+		log.Error("Failed inserting withholding rate: " + err.Error())
+		return err
+	}
+	if !ok {
+		if _, err := stub.ReplaceRow("WithholdingRates", rate.toRow()); err != nil {
+			log.Error("Failed replacing withholding rate: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// getWithholdingRate returns a zero rate for jurisdictions with no rate set.
+func (t *BondChaincode) getWithholdingRate(stub shim.ChaincodeStubInterface, issuerJurisdiction string, investorJurisdiction string) (withholdingRate, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: issuerJurisdiction}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: investorJurisdiction}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("WithholdingRates", columns)
+	if err != nil {
+		message := "Failed retrieving withholding rate. Error: " + err.Error()
+		log.Error(message)
+		return withholdingRate{}, errors.New(message)
+	}
+
+	result := withholdingRate{IssuerJurisdiction: issuerJurisdiction, InvestorJurisdiction: investorJurisdiction}
+	if len(row.Columns) != 0 {
+		result.readFromRow(row)
+	}
+	return result, nil
+}
+
+func (t *BondChaincode) getWithholdingRates(stub shim.ChaincodeStubInterface) (rates []withholdingRate, err error) {
+	rows, err := stub.GetRows("WithholdingRates", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving withholding rates. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result withholdingRate
+		result.readFromRow(row)
+		rates = append(rates, result)
+	}
+
+	return rates, nil
+}
+
+// withholdCoupon reduces the coupon to the amount the investor is paid net of
+// tax and returns the withholding owed to the tax authority.
+func (t *BondChaincode) withholdCoupon(stub shim.ChaincodeStubInterface, coupon *couponAllocation) (withholding, error) {
+	issuer, err := t.getMember(stub, coupon.Payer)
+	if err != nil {
+		return withholding{}, err
+	}
+	investor, err := t.getMember(stub, coupon.Payee)
+	if err != nil {
+		return withholding{}, err
+	}
+	rate, err := t.getWithholdingRate(stub, issuer.Jurisdiction, investor.Jurisdiction)
+	if err != nil {
+		return withholding{}, err
+	}
+
+	withholding_ := withholding{
+		InvestorId: 	coupon.Payee,
+		ContractId: 	coupon.ContractId,
+		BondId: 	coupon.BondId,
+		IssuerId: 	coupon.Payer,
+		Currency: 	coupon.Currency,
+		Gross: 		coupon.Amount,
+		RateBps: 	rate.RateBps,
+		Withheld: 	coupon.Amount * rate.RateBps / BPS_DIVISOR,
+		Authority: 	rate.Authority}
+	coupon.Amount -= withholding_.Withheld
+
+	return withholding_, nil
+}
+
+// submitWithholdings instructs the payment of the tax withheld from coupons
+// and records each withholding against its investor.
+func (t *BondChaincode) submitWithholdings(stub shim.ChaincodeStubInterface, withholdings []withholding) (error) {
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, withholding_ := range withholdings {
+		instruction, err := t.submitPayment(stub, withholding_.BondId, withholding_.Currency, paymentInstruction{
+			Payer: 		withholding_.IssuerId,
+			Payee: 		withholding_.Authority,
+			Amount: 	withholding_.Withheld,
+			Purpose: 	"withholding",
+			Reference: 	withholding_.ContractId,
+			Callback: 	"payWithholding"})
+		if err != nil {
+			log.Error("cannot submit withholding payment for contract " + withholding_.ContractId + ": " + err.Error())
+			return err
+		}
+
+		counter, err := t.incrementAndGetCounter(stub, "WithholdingsCounter")
+		if err != nil {
+			return err
+		}
+		withholding_.Id = counter
+		withholding_.PaymentId = instruction.Id
+		withholding_.Timestamp = now
+		withholding_.Year = uint64(time.Unix(int64(now), 0).UTC().Year())
+
+		if ok, err := stub.InsertRow("Withholdings", withholding_.toRow()); !ok {
+			if err == nil {
+				err = errors.New("duplicate withholding " + strconv.FormatUint(counter, 10))
+			}
+			log.Error("Failed inserting withholding: " + err.Error())
+			return err
+		}
+	}
+	log.Debugf("submitWithholdings: %d withholdings recorded", len(withholdings))
+
+	return nil
+}
+
+// payWithholding is called back by the rail once withheld tax was paid to the authority.
+func (t *BondChaincode) payWithholding(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %d", "payWithholding", instructionId, amount)
+
+	if _, err := t.confirmPayment(stub, instructionId, "payWithholding", amount); err != nil {
+		message := "Failed confirming withholding payment. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	return nil, nil
+}
+
+func (t *BondChaincode) getWithholdings(stub shim.ChaincodeStubInterface, investorId string, year uint64) (withholdings []withholding, err error) {
+	var columns []shim.Column
+	if investorId != "" {
+		columnInvestorId := shim.Column{Value: &shim.Column_String_{String_: investorId}}
+		columns = append(columns, columnInvestorId)
+	}
+
+	rows, err := stub.GetRows("Withholdings", columns)
+	if err != nil {
+		message := "Failed retrieving withholdings. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result withholding
+		result.readFromRow(row)
+		if year != 0 && result.Year != year {
+			continue
+		}
+		withholdings = append(withholdings, result)
+	}
+
+	return withholdings, nil
+}
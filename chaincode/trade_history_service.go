@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"errors"
+	"sort"
+)
+
+// tradeEvent is an append-only record of a trade state transition. Trades
+// table keeps the current state of every trade while TradeHistory keeps
+// every state it went through.
+type tradeEvent struct {
+	ContractId 	string `json:"contractId"`
+	Seq 		uint64 `json:"seq"`
+	TradeId 	uint64 `json:"tradeId"`
+	State 		string `json:"state"`
+	SellerId 	string `json:"sellerId"`
+	BuyerId 	string `json:"buyerId"`
+	Price 		uint64 `json:"price"`
+	Timestamp 	uint64 `json:"timestamp"`
+}
+
+type tradeEventsBySeq []tradeEvent
+
+func (events tradeEventsBySeq) Len() int           { return len(events) }
+func (events tradeEventsBySeq) Swap(i, j int)      { events[i], events[j] = events[j], events[i] }
+func (events tradeEventsBySeq) Less(i, j int) bool { return events[i].Seq < events[j].Seq }
+
+func (event *tradeEvent) readFromRow(row shim.Row) {
+	event.ContractId 	= row.Columns[0].GetString_()
+	event.Seq 		= row.Columns[1].GetUint64()
+	event.TradeId 		= row.Columns[2].GetUint64()
+	event.State 		= row.Columns[3].GetString_()
+	event.SellerId 		= row.Columns[4].GetString_()
+	event.BuyerId 		= row.Columns[5].GetString_()
+	event.Price 		= row.Columns[6].GetUint64()
+	event.Timestamp 	= row.Columns[7].GetUint64()
+}
+
+func (event *tradeEvent) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: event.ContractId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: event.Seq}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: event.TradeId}},
+			&shim.Column{Value: &shim.Column_String_{String_: event.State}},
+			&shim.Column{Value: &shim.Column_String_{String_: event.SellerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: event.BuyerId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: event.Price}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: event.Timestamp}}},
+	}
+}
+
+func (t *BondChaincode) initTradeHistory(stub shim.ChaincodeStubInterface) (error) {
+	// Create trade history table
+	err := stub.CreateTable("TradeHistory", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ContractId", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Seq", Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: "TradeId", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "SellerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Price", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize TradeHistory")
+		return errors.New("Failed creating TradeHistory table.")
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) appendTradeEvent(stub shim.ChaincodeStubInterface, trade_ trade) (error) {
+	seq, err := t.incrementAndGetCounter(stub, "TradeEventsCounter")
+	if err != nil {
+		return err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	event := tradeEvent{
+		ContractId: 	trade_.ContractId,
+		Seq: 		seq,
+		TradeId: 	trade_.Id,
+		State: 		trade_.State,
+		SellerId: 	trade_.SellerId,
+		BuyerId: 	trade_.BuyerId,
+		Price: 		trade_.Price,
+		Timestamp: 	now}
+
+	if ok, err := stub.InsertRow("TradeHistory", event.toRow()); !ok {
+		if err == nil {
+			err = errors.New("duplicate trade event")
+		}
+		log.Error("Failed appending trade event: " + err.Error())
+		return err
+	}
+	log.Debugf("appendTradeEvent: %+v", event)
+
+	return nil
+}
+
+func (t *BondChaincode) getContractHistory(stub shim.ChaincodeStubInterface, contractId string) ([]tradeEvent, error) {
+	var columns []shim.Column
+	columnContractId := shim.Column{Value: &shim.Column_String_{String_: contractId}}
+	columns = append(columns, columnContractId)
+
+	rows, err := stub.GetRows("TradeHistory", columns)
+	if err != nil {
+		message := "Failed retrieving trade history. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	var events []tradeEvent
+	for row := range rows {
+		var result tradeEvent
+		result.readFromRow(row)
+		events = append(events, result)
+	}
+	sort.Sort(tradeEventsBySeq(events))
+
+	return events, nil
+}
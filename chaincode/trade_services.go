@@ -1,285 +1,591 @@
-package main
-
-import (
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"errors"
-	"strconv"
-	"fmt"
-)
-
-//trades: [{
-//id: 1000,
-//contractId: 'issuer0.2017.6.13.600.0',
-//sellerId: 'issuer0',
-//price: 100,
-//state: 'offer'
-//},
-
-type trade struct {
-	Id 		uint64 `json:"id"`
-	ContractId 	string `json:"contractId"`
-	SellerId 	string `json:"sellerId"`
-	Price 		uint64 `json:"price"`
-	State 		string `json:"state"`
-}
-
-func (t *BondChaincode) GetSwiftChaincodeToCall() string {
-	chainCodeToCall := "2fe5ccdb43c37c2bab0156dc1023906166eee22c6a206befd396f5b3937a7988aa8163acca704b1cd1949e217c9404a644a8aa191334b26c8846284aab48de8e"
-	return chainCodeToCall
-}
-
-func (trade_ *trade) readFromRow(row shim.Row) {
-	log.Debugf("readFromRow: %+v", row)
-	trade_.Id 		= row.Columns[0].GetUint64()
-	trade_.ContractId 	= row.Columns[1].GetString_()
-	trade_.SellerId 	= row.Columns[2].GetString_()
-	trade_.Price 		= row.Columns[3].GetUint64()
-	trade_.State 		= row.Columns[4].GetString_()
-}
-
-func (trade_ *trade) toRow() (shim.Row) {
-	return shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Id}},
-			&shim.Column{Value: &shim.Column_String_{String_: trade_.ContractId}},
-			&shim.Column{Value: &shim.Column_String_{String_: trade_.SellerId}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Price}},
-			&shim.Column{Value: &shim.Column_String_{String_: trade_.State}}},
-	}
-}
-
-func (t *BondChaincode) initTrades(stub shim.ChaincodeStubInterface) (error) {
-	// Create trades table
-	err := stub.CreateTable("Trades", []*shim.ColumnDefinition{
-		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_UINT64, Key: true},
-		&shim.ColumnDefinition{Name: "ContractId", Type: shim.ColumnDefinition_STRING, Key: false},
-		&shim.ColumnDefinition{Name: "SellerId", Type: shim.ColumnDefinition_STRING, Key: false},
-		&shim.ColumnDefinition{Name: "Price", Type: shim.ColumnDefinition_UINT64, Key: false},
-		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
-	})
-	if err != nil {
-		log.Criticalf("Cannot initialize Trades")
-		return errors.New("Failed creating Trades table.")
-	}
-
-	err = stub.PutState("TradesCounter", []byte(strconv.FormatUint(0, 10)))
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-
-func (t *BondChaincode) archiveTrade(stub shim.ChaincodeStubInterface, id uint64) (error) {
-
-	var columns []shim.Column
-	columnID := shim.Column{Value: &shim.Column_Uint64{Uint64: id}}
-	columns = append(columns, columnID)
-
-	err := stub.DeleteRow("Trades", columns)
-	if err != nil {
-		return fmt.Errorf("archiveTrade operation failed. %s", err)
-	}
-
-	return nil
-}
-
-func (t *BondChaincode) createTradeForContract(stub shim.ChaincodeStubInterface, contract_ contract, price uint64) ([]byte, error) {
-	log.Debugf("function: %s, args: %s", "createTradeForContract", contract_.Id)
-	var trade_ trade
-	trade_.State = "offer"
-	trade_.ContractId = contract_.Id
-
-	counter, err := t.incrementAndGetCounter(stub, "TradesCounter")
-	if err != nil {
-		return nil, err
-	}
-
-	trade_.Id = counter
-	trade_.SellerId = contract_.OwnerId
-	trade_.Price = price
-
-	if ok, err := stub.InsertRow("Trades", trade_.toRow()); !ok {
-		log.Error("Failed inserting new trade: " + err.Error())
-		return nil, err
-	}
-
-	contract_.State = "offer"
-
-	_, err = t.updateContract(stub, contract_)
-	return nil, err
-}
-
-func (t *BondChaincode) sell(stub shim.ChaincodeStubInterface, contractId string, price uint64, callerName string) ([]byte, error) {
-	log.Debugf("function: %s, args: %s", "sell", contractId)
-
-	// Get Contract
-	contract_, err := t.getContractById(stub, contractId)
-	if err != nil {
-		message := "Failed retrieving contract. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-	if callerName != contract_.OwnerId{
-		message := "Only owner can sell contract"
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	if _, err := t.createTradeForContract(stub, contract_, price); err != nil {
-		message := "createTradeForContract failed. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	return nil, nil
-}
-
-func (t *BondChaincode) buy(stub shim.ChaincodeStubInterface, tradeId uint64, newOwnerId string) ([]byte, error) {
-	log.Debugf("function: %s, args: %s", "buy", tradeId)
-
-	trade_, err := t.getTradeByType(stub, "offer", tradeId)
-	if err != nil {
-		message := "Failed buying trade. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	// Get Contract
-	contract_, err := t.getContractById(stub, trade_.ContractId)
-	if err != nil {
-		message := "Failed retrieving contract. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	// Transfer Contract ownership
-	contract_.OwnerId = newOwnerId
-	contract_.State = "reserved"
-	if _, err := t.updateContract(stub, contract_); err != nil {
-		message := "Failed transfering contract ownership. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	err = t.sendPaymentInstruction(stub, trade_, newOwnerId)
-	if err != nil {
-		errStr := fmt.Sprintf("Failed to invoke swift chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, err
-	}
-
-	// Create new trade entry with "settled" state
-	trade_.State = "reserved"
-	if ok, err := stub.ReplaceRow("Trades", trade_.toRow()); !ok {
-		log.Error("Failed inserting new trade: " + err.Error())
-		return nil, err
-	}
-
-	return nil, nil
-}
-
-
-func (t *BondChaincode) confirm(stub shim.ChaincodeStubInterface, contractId string) ([]byte, error) {
-	log.Debugf("function: %s, args: %s", "buy", contractId)
-
-	trade_, err := t.getTradeForContract(stub, contractId, "reserved")
-	if err != nil {
-		message := "Failed confirming trade. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	// Get Contract
-	contract_, err := t.getContractById(stub, trade_.ContractId)
-	if err != nil {
-		message := "Failed retrieving contract. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	// Confirm Contract ownership
-	contract_.State = "active"
-	if _, err := t.updateContract(stub, contract_); err != nil {
-		message := "Failed transfering contract ownership. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	// Create new trade entry with "settled" state
-	trade_.State = "settled"
-	if ok, err := stub.ReplaceRow("Trades", trade_.toRow()); !ok {
-		log.Error("Failed inserting new trade: " + err.Error())
-		return nil, err
-	}
-
-	return nil, nil
-}
-
-func (t *BondChaincode) getAllTrades(stub shim.ChaincodeStubInterface) (trades []trade, err error) {
-	return t.getTradesByType(stub, "")
-}
-
-func (t *BondChaincode) getTradesByType(stub shim.ChaincodeStubInterface, state string) (trades []trade, err error) {
-	rows, err := stub.GetRows("Trades", []shim.Column{})
-	if err != nil {
-		message := "Failed retrieving trades. Error: " + err.Error()
-		log.Error(message)
-		return nil, errors.New(message)
-	}
-
-	for row := range rows {
-		var result trade
-		result.readFromRow(row)
-		if state != "" && result.State != state {
-			continue
-		}
-		log.Debugf("getOfferTrades result includes: %+v", result)
-		trades = append(trades, result)
-	}
-
-	return trades, nil
-}
-
-func (t *BondChaincode) getTradeByType(stub shim.ChaincodeStubInterface, state string, tradeId uint64) (trade, error) {
-	rows, err := stub.GetRows("Trades", []shim.Column{})
-	if err != nil {
-		message := "Failed retrieving trades. Error: " + err.Error()
-		log.Error(message)
-		return trade{}, errors.New(message)
-	}
-
-	for row := range rows {
-		var result trade
-		result.readFromRow(row)
-		if result.State == state && result.Id == tradeId {
-			log.Debugf("getOfferTradeForContract returns: %+v", result)
-			return result, nil
-		}
-	}
-	return trade{}, errors.New("No trades found for id " + strconv.FormatUint(tradeId, 10))
-}
-
-func (t *BondChaincode) getTradeForContract(stub shim.ChaincodeStubInterface, contractId string, state string) (trade, error) {
-	rows, err := stub.GetRows("Trades", []shim.Column{})
-	if err != nil {
-		message := "Failed retrieving trades. Error: " + err.Error()
-		log.Error(message)
-		return trade{}, errors.New(message)
-	}
-
-	for row := range rows {
-		var result trade
-		result.readFromRow(row)
-		if result.ContractId != contractId {
-			continue
-		}
-		if state != "" && result.State != state  {
-			continue
-		}
-		log.Debugf("getTradeForContract returns: %+v", result)
-		return result, nil
-	}
-	return trade{}, errors.New("No trades found for contract " + contractId)
-}
\ No newline at end of file
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"fmt"
+)
+
+//trades: [{
+//id: 1000,
+//contractId: 'issuer0.2017.6.13.600.0',
+//sellerId: 'issuer0',
+//price: 100,
+//state: 'offer'
+//},
+
+type trade struct {
+	Id 		uint64 `json:"id"`
+	ContractId 	string `json:"contractId"`
+	SellerId 	string `json:"sellerId"`
+	BuyerId 	string `json:"buyerId"`
+	SellerCompany 	string `json:"sellerCompany"`
+	BuyerCompany 	string `json:"buyerCompany"`
+	Flag 		string `json:"flag"`
+	Currency 	string `json:"currency"`
+	Price 		uint64 `json:"price"`
+	Fee 		uint64 `json:"fee"`
+	// settlement amount is the clean amount for the price plus accrued interest
+	CleanAmount 	uint64 `json:"cleanAmount"`
+	Accrued 	uint64 `json:"accrued"`
+	State 		string `json:"state"`
+	SettleBy 	uint64 `json:"settleBy"`
+}
+
+func (trade_ *trade) readFromRow(row shim.Row) {
+	log.Debugf("readFromRow: %+v", row)
+	trade_.Id 		= row.Columns[0].GetUint64()
+	trade_.ContractId 	= row.Columns[1].GetString_()
+	trade_.SellerId 	= row.Columns[2].GetString_()
+	trade_.Price 		= row.Columns[3].GetUint64()
+	trade_.State 		= row.Columns[4].GetString_()
+	trade_.SettleBy 	= row.Columns[5].GetUint64()
+	trade_.BuyerId 		= row.Columns[6].GetString_()
+	trade_.SellerCompany 	= row.Columns[7].GetString_()
+	trade_.Flag 		= row.Columns[8].GetString_()
+	trade_.Currency 	= row.Columns[9].GetString_()
+	trade_.Fee 		= row.Columns[10].GetUint64()
+	trade_.CleanAmount 	= row.Columns[11].GetUint64()
+	trade_.Accrued 		= row.Columns[12].GetUint64()
+	trade_.BuyerCompany 	= row.Columns[13].GetString_()
+}
+
+func (trade_ *trade) toRow() (shim.Row) {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Id}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.ContractId}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.SellerId}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Price}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.State}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.SettleBy}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.BuyerId}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.SellerCompany}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.Flag}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.Currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Fee}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.CleanAmount}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: trade_.Accrued}},
+			&shim.Column{Value: &shim.Column_String_{String_: trade_.BuyerCompany}}},
+	}
+}
+
+func (t *BondChaincode) initTrades(stub shim.ChaincodeStubInterface) (error) {
+	// Create trades table
+	err := stub.CreateTable("Trades", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ID", Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: "ContractId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "SellerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Price", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "State", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "SettleBy", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "SellerCompany", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Flag", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Fee", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "CleanAmount", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "Accrued", Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerCompany", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		log.Criticalf("Cannot initialize Trades")
+		return errors.New("Failed creating Trades table.")
+	}
+
+	err = stub.PutState("TradesCounter", []byte(strconv.FormatUint(0, 10)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+
+func (t *BondChaincode) archiveTrade(stub shim.ChaincodeStubInterface, id uint64) (error) {
+
+	var columns []shim.Column
+	columnID := shim.Column{Value: &shim.Column_Uint64{Uint64: id}}
+	columns = append(columns, columnID)
+
+	err := stub.DeleteRow("Trades", columns)
+	if err != nil {
+		return fmt.Errorf("archiveTrade operation failed. %s", err)
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) createTradeForContract(stub shim.ChaincodeStubInterface, contract_ contract, price uint64, sellerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "createTradeForContract", contract_.Id)
+	var trade_ trade
+	trade_.State = "offer"
+	trade_.ContractId = contract_.Id
+
+	counter, err := t.incrementAndGetCounter(stub, "TradesCounter")
+	if err != nil {
+		return nil, err
+	}
+
+	trade_.Id = counter
+	trade_.SellerId = contract_.OwnerId
+	trade_.SellerCompany = sellerCompany
+	trade_.Price = price
+	trade_.Currency = contract_.Currency
+	trade_.Flag = t.getTradeFlag(stub, contract_)
+
+	if ok, err := stub.InsertRow("Trades", trade_.toRow()); !ok {
+		log.Error("Failed inserting new trade: " + err.Error())
+		return nil, err
+	}
+	if err := t.appendTradeEvent(stub, trade_); err != nil {
+		return nil, err
+	}
+
+	contract_.State = "offer"
+
+	_, err = t.updateContract(stub, contract_)
+	return nil, err
+}
+
+// updateTrade replaces the current state of a trade and appends the transition to its history.
+func (t *BondChaincode) updateTrade(stub shim.ChaincodeStubInterface, trade_ trade) (error) {
+	log.Debugf("updateTrade: %+v", trade_)
+
+	if ok, err := stub.ReplaceRow("Trades", trade_.toRow()); !ok {
+		if err == nil {
+			err = errors.New("trade " + strconv.FormatUint(trade_.Id, 10) + " not found")
+		}
+		log.Error("Failed updating trade: " + err.Error())
+		return err
+	}
+	return t.appendTradeEvent(stub, trade_)
+}
+
+func (t *BondChaincode) sell(stub shim.ChaincodeStubInterface, contractId string, price uint64, callerName string, callerCompany string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "sell", contractId)
+
+	// Get Contract
+	contract_, err := t.getContractById(stub, contractId)
+	if err != nil {
+		message := "Failed retrieving contract. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	if !canActForOwner(contract_, callerName, callerCompany) {
+		message := "Only owner or its company can sell contract"
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	if contract_.State == "reserved" {
+		message := "Reserved contract cannot be sold until its trade settles"
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkLockup(stub, contract_, contract_.OwnerId, now); err != nil {
+		log.Error("sell rejected: " + err.Error())
+		return nil, err
+	}
+
+	if _, err := t.createTradeForContract(stub, contract_, price, callerCompany); err != nil {
+		message := "createTradeForContract failed. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	return nil, nil
+}
+
+func (t *BondChaincode) buy(stub shim.ChaincodeStubInterface, tradeId uint64, newOwnerId string, newOwnerCompany string, currency string) ([]byte, error) {
+	log.Debugf("function: %s, args: %s", "buy", tradeId)
+
+	trade_, err := t.getTradeByType(stub, "offer", tradeId)
+	if err != nil {
+		message := "Failed buying trade. Error: " + err.Error()
+		log.Error(message)
+		return nil, rejectTrade("TRADE_NOT_OFFERED", message)
+	}
+
+	// Get Contract
+	contract_, err := t.getContractById(stub, trade_.ContractId)
+	if err != nil {
+		message := "Failed retrieving contract. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	if err := t.validateTrade(stub, trade_, contract_, newOwnerId, newOwnerCompany); err != nil {
+		log.Error("buy rejected: " + err.Error())
+		return nil, err
+	}
+	if currency != "" && currency != contract_.Currency {
+		return nil, rejectTrade("CURRENCY_MISMATCH", "Contract " + contract_.Id + " settles in " + contract_.Currency + ", not " + currency)
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkEligibility(stub, newOwnerId, now); err != nil {
+		log.Error("buy rejected: " + err.Error())
+		return nil, err
+	}
+	if err := t.checkRestriction(stub, trade_, contract_, newOwnerId, now); err != nil {
+		log.Error("buy rejected: " + err.Error())
+		return nil, err
+	}
+	if err := t.checkPositionLimit(stub, newOwnerCompany); err != nil {
+		log.Error("buy rejected: " + err.Error())
+		return nil, err
+	}
+	if err := t.checkConcentration(stub, contract_, newOwnerId); err != nil {
+		log.Error("buy rejected: " + err.Error())
+		return nil, err
+	}
+
+	// Reserve Contract, ownership stays with the seller until payment is confirmed
+	contract_.State = "reserved"
+	if _, err := t.updateContract(stub, contract_); err != nil {
+		message := "Failed reserving contract. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	settlementPeriod, err := t.getSettlementPeriod(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trade is reserved before the instruction goes out as some rails confirm right away
+	trade_.State = "reserved"
+	trade_.BuyerId = newOwnerId
+	trade_.BuyerCompany = newOwnerCompany
+	trade_.Flag = t.getTradeFlag(stub, contract_)
+	trade_.SettleBy = now + settlementPeriod
+
+	bond_, err := t.getBond(stub, contract_.IssuerId, contract_.BondId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trade settles at dirty price, the seller is paid interest accrued since the last coupon
+	//  1000 * trade_.Price =  ( 100000 / 100 ) * trade_.Price
+	trade_.CleanAmount = 1000 * trade_.Price
+	trade_.Accrued = bond_.getAccruedInterest(now)
+	fee, err := t.getTradeFee(stub, trade_, contract_, trade_.CleanAmount)
+	if err != nil {
+		return nil, err
+	}
+	trade_.Fee = fee.Amount
+
+	// Trade with a sanctioned counterparty is held for compliance review without paying
+	matched, err := t.screenTrade(stub, trade_)
+	if err != nil {
+		return nil, err
+	}
+	if matched != "" {
+		log.Errorf("buy held: %s matches sanctions list", matched)
+		trade_.State = "held"
+		return nil, t.updateTrade(stub, trade_)
+	}
+
+	if err := t.updateTrade(stub, trade_); err != nil {
+		return nil, err
+	}
+
+	return nil, t.submitTradePayments(stub, trade_, contract_, fee)
+}
+
+// submitTradePayments instructs the buyer's payment of a reserved trade and its fee.
+func (t *BondChaincode) submitTradePayments(stub shim.ChaincodeStubInterface, trade_ trade, contract_ contract, fee paymentInstruction) (error) {
+	instruction, err := t.submitPayment(stub, contract_.BondId, contract_.Currency, paymentInstruction{
+		Payer: 		trade_.BuyerId,
+		Payee: 		trade_.SellerId,
+		Amount: 	trade_.CleanAmount + trade_.Accrued,
+		Purpose: 	"payment",
+		Reference: 	trade_.ContractId,
+		TradeId: 	trade_.Id,
+		Callback: 	"confirm"})
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to submit payment instruction. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return err
+	}
+	// the trade was released if the rail refused the payment, a rail settling
+	// in the transaction confirmed it already
+	principal, err := t.getPayment(stub, instruction.Payload)
+	if err != nil {
+		return err
+	}
+	// a rail settling in the transaction fails the buy, the buyer sees why
+	if principal.Status == "failed" && (principal.Rail == CASH_RAIL || principal.Rail == TOKEN_RAIL) {
+		return errors.New("Payment for trade " + strconv.FormatUint(trade_.Id, 10) + " failed: " + principal.Reason)
+	}
+	if principal.Status != "submitted" && principal.Status != "confirmed" {
+		return nil
+	}
+
+	if fee.Amount > 0 {
+		if _, err := t.submitPayment(stub, contract_.BondId, contract_.Currency, fee); err != nil {
+			log.Error("Failed to submit fee payment instruction: " + err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func (t *BondChaincode) confirm(stub shim.ChaincodeStubInterface, instructionId string, amount uint64) ([]byte, error) {
+	log.Debugf("function: %s, args: %s, %d", "confirm", instructionId, amount)
+
+	// the trade may have been released while the payment was under way, the buyer is paid back
+	if instruction, err := t.getPayment(stub, instructionId); err == nil && instruction.Callback == "confirm" && instruction.Status == "cancelled" {
+		return nil, t.refundPayment(stub, instruction, amount, "trade " + strconv.FormatUint(instruction.TradeId, 10) + " was released before payment")
+	}
+
+	instruction, err := t.confirmPayment(stub, instructionId, "confirm", amount)
+	if err != nil {
+		message := "Failed confirming payment. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	trade_, err := t.getTradeByType(stub, "reserved", instruction.TradeId)
+	if err != nil {
+		log.Error("Failed confirming trade. Error: " + err.Error())
+		return nil, t.refundPayment(stub, instruction, amount, "trade " + strconv.FormatUint(instruction.TradeId, 10) + " is no longer reserved")
+	}
+
+	// Get Contract
+	contract_, err := t.getContractById(stub, trade_.ContractId)
+	if err != nil {
+		message := "Failed retrieving contract. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	// Transfer Contract ownership
+	contract_.OwnerId = trade_.BuyerId
+	contract_.OwnerCompany = trade_.BuyerCompany
+	contract_.State = "active"
+	if _, err := t.updateContract(stub, contract_); err != nil {
+		message := "Failed transfering contract ownership. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+	if err := t.payDeferredCoupons(stub, contract_.Id); err != nil {
+		return nil, err
+	}
+
+	trade_.State = "settled"
+	if err := t.updateTrade(stub, trade_); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// tradeRejection is returned when pre-trade validation fails; its message is
+// JSON so that clients can map the code to an explanation.
+type tradeRejection struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (rejection *tradeRejection) Error() string {
+	rejectionBytes, _ := json.Marshal(rejection)
+	return string(rejectionBytes)
+}
+
+func rejectTrade(code string, message string) (error) {
+	return &tradeRejection{Code: code, Message: message}
+}
+
+// getTradeFlag flags trades of contracts whose bond is in default.
+func (t *BondChaincode) getTradeFlag(stub shim.ChaincodeStubInterface, contract_ contract) (string) {
+	bond_, err := t.getBond(stub, contract_.IssuerId, contract_.BondId)
+	if err == nil && bond_.State == "default" {
+		return "default"
+	}
+	return ""
+}
+
+func (t *BondChaincode) validateTrade(stub shim.ChaincodeStubInterface, trade_ trade, contract_ contract, buyerId string, buyerCompany string) (error) {
+	if buyerId == trade_.SellerId || buyerId == contract_.OwnerId {
+		return rejectTrade("SELF_TRADE", "Buyer already owns the contract")
+	}
+	if buyerCompany != "" && buyerCompany == trade_.SellerCompany {
+		return rejectTrade("WASH_TRADE", "Buyer and seller belong to the same company " + buyerCompany)
+	}
+	if contract_.State != "offer" {
+		return rejectTrade("CONTRACT_NOT_OFFERED", "Contract " + contract_.Id + " is " + contract_.State)
+	}
+
+	bond_, err := t.getBond(stub, contract_.IssuerId, contract_.BondId)
+	if err != nil {
+		return rejectTrade("BOND_NOT_FOUND", err.Error())
+	}
+	// bonds in default still trade, their trades are flagged
+	if bond_.State != "active" && bond_.State != "default" {
+		return rejectTrade("BOND_NOT_ACTIVE", "Bond " + bond_.Id + " is " + bond_.State)
+	}
+	if bond_.Term <= bond_.CouponsDue {
+		return rejectTrade("BOND_MATURED", "Bond " + bond_.Id + " has matured")
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) getAllTrades(stub shim.ChaincodeStubInterface) (trades []trade, err error) {
+	return t.getTradesByType(stub, "")
+}
+
+func (t *BondChaincode) getTradesByType(stub shim.ChaincodeStubInterface, state string) (trades []trade, err error) {
+	rows, err := stub.GetRows("Trades", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving trades. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result trade
+		result.readFromRow(row)
+		if state != "" && result.State != state {
+			continue
+		}
+		log.Debugf("getOfferTrades result includes: %+v", result)
+		trades = append(trades, result)
+	}
+
+	return trades, nil
+}
+
+func (t *BondChaincode) getTradeByType(stub shim.ChaincodeStubInterface, state string, tradeId uint64) (trade, error) {
+	rows, err := stub.GetRows("Trades", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving trades. Error: " + err.Error()
+		log.Error(message)
+		return trade{}, errors.New(message)
+	}
+
+	for row := range rows {
+		var result trade
+		result.readFromRow(row)
+		if result.State == state && result.Id == tradeId {
+			log.Debugf("getOfferTradeForContract returns: %+v", result)
+			return result, nil
+		}
+	}
+	return trade{}, errors.New("No trades found for id " + strconv.FormatUint(tradeId, 10))
+}
+
+func (t *BondChaincode) getTradesForContract(stub shim.ChaincodeStubInterface, contractId string) (trades []trade, err error) {
+	rows, err := stub.GetRows("Trades", []shim.Column{})
+	if err != nil {
+		message := "Failed retrieving trades. Error: " + err.Error()
+		log.Error(message)
+		return nil, errors.New(message)
+	}
+
+	for row := range rows {
+		var result trade
+		result.readFromRow(row)
+		if result.ContractId != contractId {
+			continue
+		}
+		trades = append(trades, result)
+	}
+
+	return trades, nil
+}
+
+// getPendingTrades returns trades bought but not settled, reserved or held for compliance review.
+func (t *BondChaincode) getPendingTrades(stub shim.ChaincodeStubInterface) (trades []trade, err error) {
+	reserved, err := t.getTradesByType(stub, "reserved")
+	if err != nil {
+		return nil, err
+	}
+	held, err := t.getTradesByType(stub, "held")
+	if err != nil {
+		return nil, err
+	}
+	return append(reserved, held...), nil
+}
+
+func (t *BondChaincode) getSettlementPeriod(stub shim.ChaincodeStubInterface) (uint64, error) {
+	periodBytes, err := stub.GetState("settlementperiod")
+	if err != nil {
+		log.Error("Failed retrieving settlement period. Error: " + err.Error())
+		return 0, err
+	}
+	if len(periodBytes) == 0 {
+		return SETTLEMENT_PERIOD, nil
+	}
+	return strconv.ParseUint(string(periodBytes), 10, 64)
+}
+
+// releaseTrade reverts a reserved trade whose payment did not arrive: the
+// contract, still owned by the seller, is offered again at the same price.
+func (t *BondChaincode) releaseTrade(stub shim.ChaincodeStubInterface, trade_ trade) (error) {
+	log.Debugf("releaseTrade: %+v", trade_)
+
+	contract_, err := t.getContractById(stub, trade_.ContractId)
+	if err != nil {
+		return fmt.Errorf("releaseTrade operation failed. cannot get contract %s", err)
+	}
+
+	trade_.State = "failed"
+	if err := t.updateTrade(stub, trade_); err != nil {
+		return err
+	}
+	// a payment arriving later is refunded by confirm
+	if err := t.cancelTradePayments(stub, trade_.Id, "trade released"); err != nil {
+		return err
+	}
+	if err := t.payDeferredCoupons(stub, contract_.Id); err != nil {
+		return err
+	}
+
+	if _, err := t.createTradeForContract(stub, contract_, trade_.Price, trade_.SellerCompany); err != nil {
+		return fmt.Errorf("releaseTrade operation failed. cannot offer contract %s", err)
+	}
+
+	return nil
+}
+
+func (t *BondChaincode) releaseExpiredTrades(stub shim.ChaincodeStubInterface) (error) {
+	log.Debugf("releaseExpiredTrades called ")
+
+	trades, err := t.getTradesByType(stub, "reserved")
+	if err != nil {
+		log.Error("releaseExpiredTrades failed on retrieving trades: " + err.Error())
+		return err
+	}
+	now, err := t.getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	count := 0
+
+	for _, trade_ := range trades {
+		if trade_.SettleBy > now {
+			continue
+		}
+		err = t.releaseTrade(stub, trade_)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	log.Debugf("Expired Trades Released: %d out of %d",
+		count, len(trades))
+
+	return nil
+}